@@ -1,6 +1,214 @@
 package broker
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+var (
+	backend = flag.String("broker", os.Getenv("BROKER"), "Broker backend for streams (redis/redis-streams/memory)")
+
+	ErrNotRegistered = errors.New("Channel is not registered.")
+	ErrStreamFull    = errors.New("Stream has reached its maximum size.")
+
+	defaultBroker Broker
+	defaultMutex  sync.Mutex
+)
+
 type Registrar interface {
-	Register(key string) error
+	// Registers the channel, keeping it for ttl after its
+	// last activity. A zero ttl uses the default stream TTL.
+	Register(key string, ttl time.Duration) error
+
+	// Registers the channel like Register, recording the
+	// media type of its content as reported by Status.
+	RegisterWithType(key string, ttl time.Duration, contentType string) error
 	IsRegistered(key string) bool
+
+	// Removes the channel and disconnects its readers.
+	// Returns ErrNotRegistered if it doesn't exist.
+	Unregister(key string) error
+}
+
+// Status describes the current state of a channel.
+type Status struct {
+	Size        int64         // number of bytes written so far
+	Done        bool          // whether the writer closed the channel
+	Truncated   bool          // whether writes were dropped past the max size
+	TTL         time.Duration // time left before the channel expires
+	Subscribers int64         // number of open readers
+	ContentType string        // media type declared on registration, if any
+}
+
+// Broker is the backend holding the contents of every
+// live stream and notifying readers of new writes.
+type Broker interface {
+	Registrar
+
+	// Opens a reader on the given channel. The reader blocks
+	// until new data is written, and returns io.EOF once the
+	// channel is marked as done by its writer.
+	NewReader(key string) (io.ReadCloser, error)
+
+	// Opens a writer on the given channel. Closing the writer
+	// marks the channel as done.
+	NewWriter(key string) (io.WriteCloser, error)
+
+	// Returns a snapshot of all the data in the channel.
+	Get(key string) ([]byte, error)
+
+	// Returns the state of the channel, or ErrNotRegistered
+	// if it doesn't exist.
+	Status(key string) (*Status, error)
+
+	// Reports whether the channel of a reader returned by
+	// NewReader is done.
+	ReaderDone(rd io.Reader) bool
+
+	// Reports whether there's nothing left to read for a
+	// done channel starting from offset.
+	NoContent(rd io.Reader, offset int64) bool
+
+	// Extends the expiry of the channel of a reader returned
+	// by NewReader.
+	RenewExpiry(rd io.Reader)
+}
+
+// Creates a broker for the given backend name. An empty
+// name defaults to redis.
+func New(name string) (Broker, error) {
+	switch name {
+	case "", "redis":
+		server, err := url.Parse(*redisUrl)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisBroker(server), nil
+	case "redis-streams":
+		server, err := url.Parse(*redisUrl)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisStreamsBroker(server), nil
+	case "memory":
+		return NewMemoryBroker(), nil
+	}
+	return nil, fmt.Errorf("unknown broker: %q", name)
+}
+
+// Returns the broker selected with the `-broker` flag,
+// creating it on first use.
+func Default() Broker {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+
+	if defaultBroker == nil {
+		b, err := New(*backend)
+		if err != nil {
+			log.Fatalf("broker.default error=%v", err)
+		}
+		defaultBroker = b
+	}
+	return defaultBroker
+}
+
+// Replaces the broker used by the package level functions.
+func SetDefault(b Broker) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+
+	defaultBroker = b
+}
+
+func Register(key string, ttl time.Duration) error {
+	return Default().Register(key, ttl)
+}
+
+func RegisterWithType(key string, ttl time.Duration, contentType string) error {
+	return Default().RegisterWithType(key, ttl, contentType)
+}
+
+func IsRegistered(key string) bool {
+	return Default().IsRegistered(key)
+}
+
+func Unregister(key string) error {
+	return Default().Unregister(key)
+}
+
+func NewReader(key string) (io.ReadCloser, error) {
+	return Default().NewReader(key)
+}
+
+func NewWriter(key string) (io.WriteCloser, error) {
+	return Default().NewWriter(key)
+}
+
+func Get(key string) ([]byte, error) {
+	return Default().Get(key)
+}
+
+func GetStatus(key string) (*Status, error) {
+	return Default().Status(key)
+}
+
+func ReaderDone(rd io.Reader) bool {
+	return Default().ReaderDone(rd)
+}
+
+func NoContent(rd io.Reader, offset int64) bool {
+	return Default().NoContent(rd, offset)
+}
+
+func RenewExpiry(rd io.Reader) {
+	Default().RenewExpiry(rd)
+}
+
+// Overflow policies for writes past the maximum stream size.
+const (
+	OverflowReject   = "reject"
+	OverflowTruncate = "truncate"
+)
+
+// Caps a write of p to a stream currently holding size bytes,
+// according to the `-maxStreamSize` and `-streamOverflow` flags.
+//
+// Returns the part of p to append and whether this write
+// truncated the stream. Under the reject policy, writes
+// that don't fit return ErrStreamFull and nothing is appended.
+func limit(key string, size int64, p []byte) ([]byte, bool, error) {
+	max := *util.MaxStreamSize
+	if max <= 0 || size+int64(len(p)) <= max {
+		return p, false, nil
+	}
+
+	if *util.StreamOverflow != OverflowTruncate {
+		util.CountWithData("broker.stream.full", 1, "key=%s policy=%s", key, OverflowReject)
+		return nil, false, ErrStreamFull
+	}
+
+	// Already truncated, drop the data silently.
+	if size >= max {
+		return nil, false, nil
+	}
+
+	util.CountWithData("broker.stream.full", 1, "key=%s policy=%s", key, OverflowTruncate)
+	return p[:max-size], true, nil
+}
+
+// Returns ttl, or the default stream TTL if it's zero.
+func streamTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return *util.DefaultStreamTTL
+	}
+	return ttl
 }
@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/crypt"
+)
+
+// Holds the envelope of the channel's data key. Channels
+// without one are stored in plaintext, which is also how
+// channels registered before encryption got enabled stay
+// readable.
+func (c channel) keyId() string {
+	return string(c) + ":key"
+}
+
+// Returns the envelope of a new data key for a channel
+// being registered, or "" when encryption is off.
+func newChannelKey() (string, error) {
+	if !crypt.Enabled() {
+		return "", nil
+	}
+
+	key, err := crypt.NewDataKey()
+	if err != nil {
+		return "", err
+	}
+	return key.Envelope(), nil
+}
+
+// Queues storing envelope as the channel's data key, or
+// removing a stale one when it's empty. Meant to be sent
+// as part of the Register transaction.
+func sendChannelKey(conn redis.Conn, c channel, expire int64, envelope string) {
+	if envelope == "" {
+		conn.Send("DEL", c.keyId())
+		return
+	}
+	conn.Send("SETEX", c.keyId(), expire, envelope)
+}
+
+// Loads the data key of the channel, nil when it's
+// stored in plaintext.
+func channelKey(conn redis.Conn, c channel) (*crypt.DataKey, error) {
+	envelope, err := redis.String(conn.Do("GET", c.keyId()))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return crypt.OpenDataKey(envelope)
+}
+
+// Returns the size of the data held in a channel
+// value of strlen bytes.
+func plainSize(key *crypt.DataKey, strlen int64) int64 {
+	if key == nil {
+		return strlen
+	}
+	return crypt.PlainSize(strlen)
+}
@@ -6,71 +6,200 @@ import (
 	"sync"
 
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/crypt"
 	"github.com/heroku/busl/util"
 )
 
+// Writes to the channel, unless it was unregistered in the
+// meantime: the write would recreate its keys otherwise.
+// Readers get notified of the write.
+//
+// KEYS: id, key, truncated, ttl, type, done
+// ARGV: data, offset (-1 to append), expire, truncated (1 or 0)
+var writeScript = redis.NewScript(6, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+if ARGV[2] == '-1' then
+  redis.call('APPEND', KEYS[1], ARGV[1])
+else
+  redis.call('SETRANGE', KEYS[1], ARGV[2], ARGV[1])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call('EXPIRE', KEYS[2], ARGV[3])
+if ARGV[4] == '1' then
+  redis.call('SETEX', KEYS[3], ARGV[3], 1)
+end
+redis.call('EXPIRE', KEYS[4], ARGV[3])
+redis.call('EXPIRE', KEYS[5], ARGV[3])
+redis.call('DEL', KEYS[6])
+redis.call('PUBLISH', KEYS[1], 1)
+return 1
+`)
+
+// Marks the channel as done, unless it was unregistered.
+//
+// KEYS: id, done, kill
+// ARGV: expire
+var closeScript = redis.NewScript(3, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+redis.call('SETEX', KEYS[2], ARGV[1], 1)
+redis.call('PUBLISH', KEYS[3], 1)
+return 1
+`)
+
 type writer struct {
+	pool    *redis.Pool
 	channel channel
+	expire  int64
+	key     *crypt.DataKey // nil for plaintext channels
 }
 
-var ErrNotRegistered = errors.New("Channel is not registered.")
-
-func NewWriter(key string) (io.WriteCloser, error) {
-	if !NewRedisRegistrar().IsRegistered(key) {
+func (b *RedisBroker) NewWriter(key string) (io.WriteCloser, error) {
+	if !b.IsRegistered(key) {
 		return nil, ErrNotRegistered
 	}
 
-	return &writer{channel(key)}, nil
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+	dataKey, err := channelKey(conn, channel)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{b.pool, channel, channelExpire(conn, channel), dataKey}, nil
 }
 
 func (w *writer) Close() error {
-	conn := redisPool.Get()
+	conn := w.pool.Get()
 	defer conn.Close()
 
-	conn.Send("MULTI")
-	conn.Send("SETEX", w.channel.doneId(), redisChannelExpire, []byte{1})
-	conn.Send("PUBLISH", w.channel.killId(), 1)
-	_, err := conn.Do("EXEC")
+	ok, err := redis.Bool(closeScript.Do(conn, w.channel.id(), w.channel.doneId(), w.channel.killId(), w.expire))
+	if err == nil && !ok {
+		err = ErrNotRegistered
+	}
 	return err
 }
 
 func (w *writer) Write(p []byte) (int, error) {
-	conn := redisPool.Get()
+	conn := w.pool.Get()
 	defer conn.Close()
 
-	conn.Send("MULTI")
-	conn.Send("APPEND", w.channel.id(), p)
-	conn.Send("EXPIRE", w.channel.id(), redisChannelExpire)
-	conn.Send("DEL", w.channel.doneId())
-	conn.Send("PUBLISH", w.channel.id(), 1)
+	data, truncated, err := w.limit(conn, p)
+	if err != nil {
+		return 0, err
+	}
 
-	_, err := conn.Do("EXEC")
-	return len(p), err
+	offset := int64(-1)
+	if w.key != nil && len(data) > 0 {
+		if offset, data, err = w.seal(conn, data); err != nil {
+			return 0, err
+		}
+	}
+
+	flag := 0
+	if truncated {
+		flag = 1
+	}
+
+	ok, err := redis.Bool(writeScript.Do(conn,
+		w.channel.id(), w.channel.keyId(), w.channel.truncatedId(), w.channel.ttlId(), w.channel.typeId(), w.channel.doneId(),
+		data, offset, w.expire, flag))
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrNotRegistered
+	}
+	return len(p), nil
+}
+
+// Caps p to the max stream size. A stream has a single
+// publisher in practice, so the size check isn't done
+// atomically with the append.
+func (w *writer) limit(conn redis.Conn, p []byte) ([]byte, bool, error) {
+	if *util.MaxStreamSize <= 0 {
+		return p, false, nil
+	}
+
+	size, err := redis.Int64(conn.Do("STRLEN", w.channel.id()))
+	if err != nil {
+		return nil, false, err
+	}
+	return limit(string(w.channel), plainSize(w.key, size), p)
+}
+
+// Encrypted channels are stored as a sequence of fixed size
+// slots, each holding a sealed chunk. Only the last chunk can
+// be partial: it's opened and sealed again along with data,
+// the result going over its slot. Returns where to write the
+// sealed data. As with limit, this relies on a single
+// publisher per channel.
+func (w *writer) seal(conn redis.Conn, data []byte) (int64, []byte, error) {
+	size, err := redis.Int64(conn.Do("STRLEN", w.channel.id()))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	index := size / crypt.SlotSize
+	offset := index * crypt.SlotSize
+
+	if offset < size {
+		slot, err := redis.Bytes(conn.Do("GETRANGE", w.channel.id(), offset, size-1))
+		if err != nil {
+			return 0, nil, err
+		}
+		tail, err := w.key.Open(index, slot)
+		if err != nil {
+			return 0, nil, err
+		}
+		data = append(tail, data...)
+	}
+	return offset, w.key.SealChunks(index, data), nil
 }
 
 type reader struct {
+	pool     *redis.Pool
 	channel  channel
 	psc      redis.PubSubConn
 	offset   int64
+	expire   int64
 	replayed bool
 	closed   bool
 	mutex    *sync.Mutex
 	buffered bool
+	key      *crypt.DataKey // nil for plaintext channels
 }
 
-func NewReader(key string) (io.ReadCloser, error) {
-	if !NewRedisRegistrar().IsRegistered(key) {
+func (b *RedisBroker) NewReader(key string) (io.ReadCloser, error) {
+	if !b.IsRegistered(key) {
 		return nil, ErrNotRegistered
 	}
 
-	psc := redis.PubSubConn{redisPool.Get()}
+	conn := b.pool.Get()
+	defer conn.Close()
+
 	channel := channel(key)
+	dataKey, err := channelKey(conn, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	psc := redis.PubSubConn{Conn: b.pool.Get()}
 	psc.PSubscribe(channel.wildcardId())
 
 	rd := &reader{
+		pool:    b.pool,
 		channel: channel,
+		expire:  channelExpire(conn, channel),
 		psc:     psc,
-		mutex:   &sync.Mutex{}}
+		mutex:   &sync.Mutex{},
+		key:     dataKey}
+
+	subscribe(conn, channel, rd.expire)
 
 	return rd, nil
 }
@@ -162,22 +291,40 @@ func (r *reader) read(msg redis.PMessage, p []byte) (n int, err error) {
 }
 
 func (r *reader) fetch(length int) ([]byte, error) {
-	conn := redisPool.Get()
+	conn := r.pool.Get()
 	defer conn.Close()
 
 	start, end := r.offset, r.offset+int64(length)
 
+	// Encrypted channels are read by whole slots.
+	first, last := start, end
+	if r.key != nil {
+		first = start / crypt.ChunkSize * crypt.SlotSize
+		last = (end + crypt.ChunkSize - 1) / crypt.ChunkSize * crypt.SlotSize
+	}
+
 	conn.Send("MULTI")
-	conn.Send("GETRANGE", r.channel.id(), start, end-1)
+	conn.Send("GETRANGE", r.channel.id(), first, last-1)
 	conn.Send("STRLEN", r.channel.id())
 	conn.Send("EXISTS", r.channel.doneId())
-	conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
+	conn.Send("EXPIRE", r.channel.id(), r.expire)
+	conn.Send("EXPIRE", r.channel.ttlId(), r.expire)
+	conn.Send("EXPIRE", r.channel.keyId(), r.expire)
+	conn.Send("EXPIRE", r.channel.typeId(), r.expire)
+	conn.Send("EXPIRE", r.channel.subscribersId(), r.expire)
 
 	list, err := redis.Values(conn.Do("EXEC"))
 	data, err := redis.Bytes(list[0], err)
 	size, err := redis.Int64(list[1], err)
 	done, err := redis.Bool(list[2], err)
 
+	if r.key != nil && err == nil {
+		size = crypt.PlainSize(size)
+		if data, err = openRange(r.key, data, start, end); err != nil {
+			return nil, err
+		}
+	}
+
 	if r.buffered = end < size; !r.buffered && done {
 		err = io.EOF
 	}
@@ -185,6 +332,27 @@ func (r *reader) fetch(length int) ([]byte, error) {
 	return data, err
 }
 
+// Opens the chunks fetched for [start, end), keeping
+// only that part of the data.
+func openRange(key *crypt.DataKey, sealed []byte, start, end int64) ([]byte, error) {
+	index := start / crypt.ChunkSize
+	plain, err := key.OpenChunks(index, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := start - index*crypt.ChunkSize
+	if skip >= int64(len(plain)) {
+		return []byte{}, nil
+	}
+	plain = plain[skip:]
+
+	if int64(len(plain)) > end-start {
+		plain = plain[:end-start]
+	}
+	return plain, nil
+}
+
 func (r *reader) Close() error {
 	if r.closed {
 		return nil
@@ -193,12 +361,20 @@ func (r *reader) Close() error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	if r.closed {
+		return nil
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+	unsubscribe(conn, r.channel, r.expire)
+
 	r.closed = true
 	r.psc.Unsubscribe()
 	return r.psc.Close()
 }
 
-func ReaderDone(rd io.Reader) bool {
+func (b *RedisBroker) ReaderDone(rd io.Reader) bool {
 	r, ok := rd.(*reader)
 	if !ok {
 		return false
@@ -208,39 +384,44 @@ func ReaderDone(rd io.Reader) bool {
 		return true
 	}
 
-	conn := redisPool.Get()
+	conn := b.pool.Get()
 	defer conn.Close()
 
 	done, _ := redis.Bool(conn.Do("EXISTS", r.channel.doneId()))
 	return done
 }
 
-func NoContent(rd io.Reader, offset int64) bool {
-	if !ReaderDone(rd) {
+func (b *RedisBroker) NoContent(rd io.Reader, offset int64) bool {
+	if !b.ReaderDone(rd) {
 		return false
 	}
 
-	conn := redisPool.Get()
+	conn := b.pool.Get()
 	defer conn.Close()
 
-	strlen, err := redis.Int64(conn.Do("STRLEN", rd.(*reader).channel.id()))
+	r := rd.(*reader)
+	strlen, err := redis.Int64(conn.Do("STRLEN", r.channel.id()))
 	if err != nil {
 		return false
 	}
 
-	return offset > (strlen - 1)
+	return offset > (plainSize(r.key, strlen) - 1)
 }
 
-func RenewExpiry(rd io.Reader) {
+func (b *RedisBroker) RenewExpiry(rd io.Reader) {
 	r, ok := rd.(*reader)
 	if !ok {
 		return
 	}
 
-	conn := redisPool.Get()
+	conn := b.pool.Get()
 	defer conn.Close()
 
 	conn.Send("MULTI")
-	conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
+	conn.Send("EXPIRE", r.channel.id(), r.expire)
+	conn.Send("EXPIRE", r.channel.ttlId(), r.expire)
+	conn.Send("EXPIRE", r.channel.keyId(), r.expire)
+	conn.Send("EXPIRE", r.channel.typeId(), r.expire)
+	conn.Send("EXPIRE", r.channel.subscribersId(), r.expire)
 	conn.Do("EXEC")
 }
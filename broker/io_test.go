@@ -14,17 +14,15 @@ import (
 )
 
 func setup() string {
-	registrar := NewRedisRegistrar()
 	uuid, _ := util.NewUUID()
-	registrar.Register(uuid)
+	Register(uuid, 0)
 
 	return uuid
 }
 
 func newReaderWriter() (io.ReadCloser, io.WriteCloser) {
-	registrar := NewRedisRegistrar()
 	uuid, _ := util.NewUUID()
-	registrar.Register(uuid)
+	Register(uuid, 0)
 	r, _ := NewReader(uuid)
 	w, _ := NewWriter(uuid)
 
@@ -0,0 +1,307 @@
+package broker
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// MemoryBroker keeps all channels in process memory. It's
+// meant for single node deployments and tests, where
+// running a redis instance is unnecessary.
+type MemoryBroker struct {
+	mutex    sync.Mutex
+	channels map[string]*memoryChannel
+}
+
+type memoryChannel struct {
+	cond        *sync.Cond // signaled on every write and close
+	buf         []byte
+	done        bool
+	truncated   bool // set once writes were dropped past the max size
+	killed      bool // set once the channel is unregistered
+	readers     int64
+	ttl         time.Duration
+	expires     time.Time
+	contentType string
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{channels: make(map[string]*memoryChannel)}
+}
+
+func (b *MemoryBroker) Register(key string, ttl time.Duration) error {
+	return b.RegisterWithType(key, ttl, "")
+}
+
+func (b *MemoryBroker) RegisterWithType(key string, ttl time.Duration, contentType string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.sweep()
+
+	ch := &memoryChannel{
+		cond:        sync.NewCond(&b.mutex),
+		buf:         make([]byte, 0),
+		ttl:         streamTTL(ttl),
+		contentType: contentType,
+	}
+	ch.touch()
+	b.channels[key] = ch
+
+	return nil
+}
+
+func (b *MemoryBroker) IsRegistered(key string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.lookup(key) != nil
+}
+
+func (b *MemoryBroker) Unregister(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := b.lookup(key)
+	if ch == nil {
+		return ErrNotRegistered
+	}
+
+	delete(b.channels, key)
+	ch.killed = true
+	ch.cond.Broadcast()
+
+	return nil
+}
+
+func (b *MemoryBroker) NewReader(key string) (io.ReadCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := b.lookup(key)
+	if ch == nil {
+		return nil, ErrNotRegistered
+	}
+	ch.readers++
+	return &memoryReader{broker: b, channel: ch}, nil
+}
+
+func (b *MemoryBroker) NewWriter(key string) (io.WriteCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := b.lookup(key)
+	if ch == nil {
+		return nil, ErrNotRegistered
+	}
+	return &memoryWriter{broker: b, key: key, channel: ch}, nil
+}
+
+func (b *MemoryBroker) Get(key string) ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := b.lookup(key)
+	if ch == nil {
+		return nil, ErrNotRegistered
+	}
+
+	buf := make([]byte, len(ch.buf))
+	copy(buf, ch.buf)
+	return buf, nil
+}
+
+func (b *MemoryBroker) Status(key string) (*Status, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := b.lookup(key)
+	if ch == nil {
+		return nil, ErrNotRegistered
+	}
+
+	return &Status{
+		Size:        int64(len(ch.buf)),
+		Done:        ch.done,
+		Truncated:   ch.truncated,
+		TTL:         ch.expires.Sub(time.Now()),
+		Subscribers: ch.readers,
+		ContentType: ch.contentType,
+	}, nil
+}
+
+func (b *MemoryBroker) ReaderDone(rd io.Reader) bool {
+	r, ok := rd.(*memoryReader)
+	if !ok {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return r.closed || r.channel.done || r.channel.killed
+}
+
+func (b *MemoryBroker) NoContent(rd io.Reader, offset int64) bool {
+	r, ok := rd.(*memoryReader)
+	if !ok {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !r.closed && !r.channel.done && !r.channel.killed {
+		return false
+	}
+	return offset > int64(len(r.channel.buf)-1)
+}
+
+func (b *MemoryBroker) RenewExpiry(rd io.Reader) {
+	r, ok := rd.(*memoryReader)
+	if !ok {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	r.channel.touch()
+}
+
+// Returns the channel registered under key, dropping
+// it if it has expired. Must be called with the mutex held.
+func (b *MemoryBroker) lookup(key string) *memoryChannel {
+	ch, ok := b.channels[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(ch.expires) {
+		delete(b.channels, key)
+		return nil
+	}
+	return ch
+}
+
+// Drops every expired channel. Must be called with the mutex held.
+func (b *MemoryBroker) sweep() {
+	now := time.Now()
+	for key, ch := range b.channels {
+		if now.After(ch.expires) {
+			delete(b.channels, key)
+		}
+	}
+}
+
+func (ch *memoryChannel) touch() {
+	ch.expires = time.Now().Add(ch.ttl)
+}
+
+type memoryWriter struct {
+	broker  *MemoryBroker
+	key     string
+	channel *memoryChannel
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	w.broker.mutex.Lock()
+	defer w.broker.mutex.Unlock()
+
+	if w.channel.killed {
+		return 0, ErrNotRegistered
+	}
+
+	data, truncated, err := limit(w.key, int64(len(w.channel.buf)), p)
+	if err != nil {
+		return 0, err
+	}
+	if truncated {
+		w.channel.truncated = true
+	}
+
+	w.channel.buf = append(w.channel.buf, data...)
+	w.channel.done = false
+	w.channel.touch()
+	w.channel.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (w *memoryWriter) Close() error {
+	w.broker.mutex.Lock()
+	defer w.broker.mutex.Unlock()
+
+	if w.channel.killed {
+		return ErrNotRegistered
+	}
+
+	w.channel.done = true
+	w.channel.cond.Broadcast()
+
+	return nil
+}
+
+type memoryReader struct {
+	broker  *MemoryBroker
+	channel *memoryChannel
+	offset  int64
+	closed  bool
+}
+
+func (r *memoryReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return 0, errWhence
+	case 0:
+		r.offset = offset
+	case 1:
+		r.offset += offset
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+
+	return r.offset, nil
+}
+
+// Blocks until there's data past the current offset,
+// the channel is done or the reader is closed.
+func (r *memoryReader) Read(p []byte) (int, error) {
+	r.broker.mutex.Lock()
+	defer r.broker.mutex.Unlock()
+
+	for {
+		if r.closed || r.channel.killed {
+			return 0, io.EOF
+		}
+
+		if size := int64(len(r.channel.buf)); r.offset < size {
+			n := copy(p, r.channel.buf[r.offset:])
+			r.offset += int64(n)
+			r.channel.touch()
+			return n, nil
+		}
+
+		if r.channel.done {
+			return 0, io.EOF
+		}
+
+		r.channel.cond.Wait()
+	}
+}
+
+func (r *memoryReader) Close() error {
+	r.broker.mutex.Lock()
+	defer r.broker.mutex.Unlock()
+
+	if !r.closed {
+		r.channel.readers--
+	}
+
+	r.closed = true
+	r.channel.cond.Broadcast()
+
+	return nil
+}
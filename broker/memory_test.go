@@ -0,0 +1,263 @@
+package broker
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/heroku/busl/util"
+)
+
+func newMemoryReaderWriter() (*MemoryBroker, io.ReadCloser, io.WriteCloser) {
+	b := NewMemoryBroker()
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, 0)
+	r, _ := b.NewReader(uuid)
+	w, _ := b.NewWriter(uuid)
+
+	return b, r, w
+}
+
+func TestMemoryRegistered(t *testing.T) {
+	b := NewMemoryBroker()
+	uuid, _ := util.NewUUID()
+	assert.False(t, b.IsRegistered(uuid))
+
+	_, err := b.NewReader(uuid)
+	assert.Equal(t, err, ErrNotRegistered)
+
+	_, err = b.NewWriter(uuid)
+	assert.Equal(t, err, ErrNotRegistered)
+
+	b.Register(uuid, 0)
+	assert.True(t, b.IsRegistered(uuid))
+}
+
+func TestMemoryExpired(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Register("1/2/3", 0)
+	b.channels["1/2/3"].expires = time.Now().Add(-time.Second)
+
+	assert.False(t, b.IsRegistered("1/2/3"))
+}
+
+func TestMemoryTTL(t *testing.T) {
+	b := NewMemoryBroker()
+
+	b.Register("1/2/3", 0)
+	assert.Equal(t, *util.DefaultStreamTTL, b.channels["1/2/3"].ttl)
+
+	b.Register("4/5/6", time.Hour)
+	assert.Equal(t, time.Hour, b.channels["4/5/6"].ttl)
+	assert.True(t, b.channels["4/5/6"].expires.After(time.Now().Add(59*time.Minute)))
+}
+
+func TestMemoryPubSub(t *testing.T) {
+	_, r, w := newMemoryReaderWriter()
+	defer r.Close()
+
+	done := make(chan []byte)
+	go func() {
+		buf, _ := ioutil.ReadAll(r)
+		done <- buf
+	}()
+
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	assert.Equal(t, "busl hello world", string(<-done))
+}
+
+func TestMemorySeek(t *testing.T) {
+	b, r, w := newMemoryReaderWriter()
+	defer r.Close()
+
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	r.(io.Seeker).Seek(10, 0)
+	buf, _ := ioutil.ReadAll(r)
+	assert.Equal(t, " world", string(buf))
+
+	assert.True(t, b.ReaderDone(r))
+	assert.False(t, b.NoContent(r, 15))
+	assert.True(t, b.NoContent(r, 16))
+}
+
+func TestMemoryOverflowingBuffer(t *testing.T) {
+	_, r, w := newMemoryReaderWriter()
+	defer r.Close()
+
+	w.Write(bytes.Repeat([]byte("0"), 32768))
+	w.Write([]byte("A"))
+
+	done := make(chan int64)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, r)
+		done <- n
+	}()
+	w.Close()
+	assert.Equal(t, int64(32769), <-done)
+}
+
+func TestMemoryCloseUnblocksRead(t *testing.T) {
+	_, r, _ := newMemoryReaderWriter()
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		done <- err
+	}()
+
+	r.Close()
+	assert.Equal(t, io.EOF, <-done)
+}
+
+func TestMemoryGet(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Register("1/2/3", 0)
+
+	w, _ := b.NewWriter("1/2/3")
+	w.Write([]byte("hello"))
+
+	buf, err := b.Get("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	_, err = b.Get("4/5/6")
+	assert.Equal(t, err, ErrNotRegistered)
+}
+
+func TestMemoryReaderDone(t *testing.T) {
+	b, r, w := newMemoryReaderWriter()
+	assert.False(t, b.ReaderDone(r))
+	assert.False(t, b.ReaderDone(strings.NewReader("hello")))
+
+	w.Close()
+	assert.True(t, b.ReaderDone(r))
+
+	// Writing again reopens the channel.
+	w.Write([]byte("hello"))
+	assert.False(t, b.ReaderDone(r))
+}
+
+func TestMemoryMaxSizeReject(t *testing.T) {
+	*util.MaxStreamSize = 8
+	defer func() {
+		*util.MaxStreamSize = 0
+	}()
+
+	b, r, w := newMemoryReaderWriter()
+
+	n, err := w.Write([]byte("hello"))
+	assert.Equal(t, 5, n)
+	assert.Nil(t, err)
+
+	n, err = w.Write([]byte(" world"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrStreamFull, err)
+
+	w.Close()
+	buf, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "hello", string(buf))
+	assert.False(t, r.(*memoryReader).channel.truncated)
+	assert.True(t, b.ReaderDone(r))
+}
+
+func TestMemoryMaxSizeTruncate(t *testing.T) {
+	*util.MaxStreamSize = 8
+	*util.StreamOverflow = OverflowTruncate
+	defer func() {
+		*util.MaxStreamSize = 0
+		*util.StreamOverflow = OverflowReject
+	}()
+
+	_, r, w := newMemoryReaderWriter()
+
+	for _, s := range []string{"hello", " world", " again"} {
+		n, err := w.Write([]byte(s))
+		assert.Equal(t, len(s), n)
+		assert.Nil(t, err)
+	}
+
+	w.Close()
+	buf, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "hello wo", string(buf))
+	assert.True(t, r.(*memoryReader).channel.truncated)
+}
+
+func TestMemoryUnregister(t *testing.T) {
+	b := NewMemoryBroker()
+	b.Register("1/2/3", 0)
+
+	w, _ := b.NewWriter("1/2/3")
+	w.Write([]byte("hello"))
+
+	r, _ := b.NewReader("1/2/3")
+	defer r.Close()
+
+	assert.Nil(t, b.Unregister("1/2/3"))
+	assert.False(t, b.IsRegistered("1/2/3"))
+	assert.Equal(t, ErrNotRegistered, b.Unregister("1/2/3"))
+
+	// Readers are disconnected right away.
+	_, err := r.Read(make([]byte, 10))
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, b.ReaderDone(r))
+
+	// Publishers too, without bringing the channel back.
+	_, err = w.Write([]byte(" world"))
+	assert.Equal(t, ErrNotRegistered, err)
+	assert.Equal(t, ErrNotRegistered, w.Close())
+	assert.False(t, b.IsRegistered("1/2/3"))
+}
+
+func TestMemoryStatus(t *testing.T) {
+	b := NewMemoryBroker()
+	_, err := b.Status("1/2/3")
+	assert.Equal(t, ErrNotRegistered, err)
+
+	b.Register("1/2/3", time.Minute)
+	w, _ := b.NewWriter("1/2/3")
+	w.Write([]byte("hello"))
+
+	r1, _ := b.NewReader("1/2/3")
+	r2, _ := b.NewReader("1/2/3")
+	r2.Close()
+	r2.Close()
+
+	status, err := b.Status("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), status.Size)
+	assert.False(t, status.Done)
+	assert.Equal(t, int64(1), status.Subscribers)
+	assert.True(t, status.TTL > 59*time.Second)
+
+	w.Close()
+	r1.Close()
+
+	status, _ = b.Status("1/2/3")
+	assert.True(t, status.Done)
+	assert.Equal(t, int64(0), status.Subscribers)
+}
+
+func TestMemoryContentType(t *testing.T) {
+	b := NewMemoryBroker()
+
+	b.RegisterWithType("1/2/3", 0, "application/x-ndjson")
+	status, _ := b.Status("1/2/3")
+	assert.Equal(t, "application/x-ndjson", status.ContentType)
+
+	// Registering again resets it.
+	b.Register("1/2/3", 0)
+	status, _ = b.Status("1/2/3")
+	assert.Equal(t, "", status.ContentType)
+}
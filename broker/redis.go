@@ -8,31 +8,18 @@ import (
 	"time"
 
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/crypt"
+	"github.com/heroku/busl/metrics"
 	"github.com/heroku/busl/util"
 )
 
-var (
-	redisUrl           = flag.String("redisUrl", os.Getenv("REDIS_URL"), "URL of the redis server")
-	redisServer        *url.URL
-	redisPool          *redis.Pool
-	redisKeyExpire     = 60 // redis uses seconds for EXPIRE
-	redisChannelExpire = redisKeyExpire * 5
-)
-
-func init() {
-	flag.Parse()
-	redisServer, _ = url.Parse(*redisUrl)
-	redisPool = newPool(redisServer)
-
-	conn := redisPool.Get()
-	defer conn.Close()
-}
+var redisUrl = flag.String("redisUrl", os.Getenv("REDIS_URL"), "URL of the redis server")
 
 func newPool(server *url.URL) *redis.Pool {
 	cleanServerURL := *server
 	cleanServerURL.User = nil
-	log.Printf("connecting to redis: %s", cleanServerURL)
-	return &redis.Pool{
+	log.Printf("connecting to redis: %s", cleanServerURL.String())
+	pool := &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 4 * time.Minute,
 		Dial: func() (c redis.Conn, err error) {
@@ -61,6 +48,11 @@ func newPool(server *url.URL) *redis.Pool {
 			return err
 		},
 	}
+
+	metrics.NewGaugeFunc("busl_redis_connections_open", "Open connections in the redis pool.", func() float64 {
+		return float64(pool.ActiveCount())
+	})
+	return pool
 }
 
 type channel string
@@ -81,21 +73,127 @@ func (c channel) killId() string {
 	return string(c) + ":kill"
 }
 
-type RedisRegistrar struct{}
+func (c channel) ttlId() string {
+	return string(c) + ":ttl"
+}
+
+func (c channel) truncatedId() string {
+	return string(c) + ":truncated"
+}
+
+func (c channel) typeId() string {
+	return string(c) + ":type"
+}
+
+func (c channel) subscribersId() string {
+	return string(c) + ":subscribers"
+}
+
+// Queues storing the content type of the channel, or removing
+// a stale one when it's empty. Meant to be sent as part of the
+// Register transaction.
+func sendChannelType(conn redis.Conn, c channel, expire int64, contentType string) {
+	if contentType == "" {
+		conn.Send("DEL", c.typeId())
+		return
+	}
+	conn.Send("SETEX", c.typeId(), expire, contentType)
+}
+
+// Tracks the number of open readers on the channel.
+func subscribe(conn redis.Conn, c channel, expire int64) {
+	conn.Send("MULTI")
+	conn.Send("INCR", c.subscribersId())
+	conn.Send("EXPIRE", c.subscribersId(), expire)
+	conn.Do("EXEC")
+}
+
+// Decrements the number of open readers, unless the counter
+// went away with the channel, renewing its expiry.
+//
+// KEYS: subscribers
+// ARGV: expire
+var unsubscribeScript = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+redis.call('DECR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+return 1
+`)
+
+func unsubscribe(conn redis.Conn, c channel, expire int64) {
+	unsubscribeScript.Do(conn, c.subscribersId(), expire)
+}
+
+// Converts a PTTL reply to a duration. Keys
+// without an expiry or missing keys return 0.
+func pttl(ms int64) time.Duration {
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func subscribers(n int64) int64 {
+	// A reader that went away without closing can
+	// leave the counter off, never report below zero.
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Redis uses seconds for EXPIRE, rounded up so that
+// sub-second TTLs don't expire keys immediately.
+func expireSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// Returns the TTL (in seconds) the channel was registered with.
+// Channels registered without one use the default stream TTL.
+func channelExpire(conn redis.Conn, c channel) int64 {
+	expire, err := redis.Int64(conn.Do("GET", c.ttlId()))
+	if err != nil || expire <= 0 {
+		return expireSeconds(streamTTL(0))
+	}
+	return expire
+}
+
+// RedisBroker stores each channel as a single string key,
+// using APPEND for writes and PUBLISH to notify readers.
+type RedisBroker struct {
+	pool *redis.Pool
+}
 
-func NewRedisRegistrar() *RedisRegistrar {
-	registrar := &RedisRegistrar{}
+func NewRedisBroker(server *url.URL) *RedisBroker {
+	return &RedisBroker{pool: newPool(server)}
+}
 
-	return registrar
+func (b *RedisBroker) Register(channelName string, ttl time.Duration) error {
+	return b.RegisterWithType(channelName, ttl, "")
 }
 
-func (rr *RedisRegistrar) Register(channelName string) (err error) {
-	conn := redisPool.Get()
+func (b *RedisBroker) RegisterWithType(channelName string, ttl time.Duration, contentType string) (err error) {
+	conn := b.pool.Get()
 	defer conn.Close()
 
 	channel := channel(channelName)
+	expire := expireSeconds(streamTTL(ttl))
 
-	_, err = conn.Do("SETEX", channel.id(), redisChannelExpire, make([]byte, 0))
+	envelope, err := newChannelKey()
+	if err != nil {
+		util.CountWithData("RedisRegistrar.Register.error", 1, "error=%s", err)
+		return
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SETEX", channel.id(), expire, make([]byte, 0))
+	conn.Send("SETEX", channel.ttlId(), expire, expire)
+	conn.Send("DEL", channel.truncatedId())
+	sendChannelKey(conn, channel, expire, envelope)
+	sendChannelType(conn, channel, expire, contentType)
+	_, err = conn.Do("EXEC")
 	if err != nil {
 		util.CountWithData("RedisRegistrar.Register.error", 1, "error=%s", err)
 		return
@@ -103,8 +201,8 @@ func (rr *RedisRegistrar) Register(channelName string) (err error) {
 	return
 }
 
-func (rr *RedisRegistrar) IsRegistered(channelName string) (registered bool) {
-	conn := redisPool.Get()
+func (b *RedisBroker) IsRegistered(channelName string) (registered bool) {
+	conn := b.pool.Get()
 	defer conn.Close()
 
 	channel := channel(channelName)
@@ -118,10 +216,83 @@ func (rr *RedisRegistrar) IsRegistered(channelName string) (registered bool) {
 	return exists
 }
 
-func Get(key string) ([]byte, error) {
-	conn := redisPool.Get()
+func (b *RedisBroker) Unregister(channelName string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := channel(channelName)
+
+	conn.Send("MULTI")
+	conn.Send("EXISTS", channel.id())
+	conn.Send("DEL", channel.id(), channel.doneId(), channel.ttlId(), channel.truncatedId(), channel.subscribersId(), channel.keyId(), channel.typeId())
+	conn.Send("PUBLISH", channel.killId(), 1)
+
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		util.CountWithData("RedisRegistrar.Unregister.error", 1, "error=%s", err)
+		return err
+	}
+
+	if exists, _ := redis.Bool(list[0], nil); !exists {
+		return ErrNotRegistered
+	}
+	return nil
+}
+
+func (b *RedisBroker) Status(channelName string) (*Status, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := channel(channelName)
+
+	conn.Send("MULTI")
+	conn.Send("EXISTS", channel.id())
+	conn.Send("STRLEN", channel.id())
+	conn.Send("EXISTS", channel.doneId())
+	conn.Send("EXISTS", channel.truncatedId())
+	conn.Send("PTTL", channel.id())
+	conn.Send("GET", channel.subscribersId())
+	conn.Send("EXISTS", channel.keyId())
+	conn.Send("GET", channel.typeId())
+
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	if exists, _ := redis.Bool(list[0], nil); !exists {
+		return nil, ErrNotRegistered
+	}
+
+	status := &Status{}
+	status.Size, _ = redis.Int64(list[1], nil)
+	if encrypted, _ := redis.Bool(list[6], nil); encrypted {
+		status.Size = crypt.PlainSize(status.Size)
+	}
+	status.Done, _ = redis.Bool(list[2], nil)
+	status.Truncated, _ = redis.Bool(list[3], nil)
+	ttl, _ := redis.Int64(list[4], nil)
+	status.TTL = pttl(ttl)
+	count, _ := redis.Int64(list[5], nil)
+	status.Subscribers = subscribers(count)
+	status.ContentType, _ = redis.String(list[7], nil)
+
+	return status, nil
+}
+
+func (b *RedisBroker) Get(key string) ([]byte, error) {
+	conn := b.pool.Get()
 	defer conn.Close()
 
 	channel := channel(key)
-	return redis.Bytes(conn.Do("GET", channel.id()))
+	data, err := redis.Bytes(conn.Do("GET", channel.id()))
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := channelKey(conn, channel)
+	if err != nil || dataKey == nil {
+		return data, err
+	}
+	return dataKey.OpenChunks(0, data)
 }
@@ -0,0 +1,670 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/crypt"
+	"github.com/heroku/busl/util"
+)
+
+// Number of entries fetched per XREAD call.
+const streamReadCount = 100
+
+// Appends a chunk to the stream. The entry ID is derived from the
+// total number of bytes written so far (`<end offset>-0`), which
+// lets readers resume from any byte offset with a single XREAD.
+// The length is passed separately, as the data may be sealed.
+// Returns -1 without writing once the channel is unregistered,
+// which would recreate its keys otherwise.
+//
+// Sealed data is bound to the end offset it was sealed for, so
+// unless ARGV[4] is -1 the write only goes through when the
+// stream is still ARGV[4] bytes long, returning -2 otherwise.
+//
+// KEYS: stream, size, done, ttl, key, type
+// ARGV: data, expire, length, expected size
+var streamWriteScript = redis.NewScript(6, `
+local current = redis.call('GET', KEYS[2])
+if not current then
+  return -1
+end
+if ARGV[4] ~= '-1' and current ~= ARGV[4] then
+  return -2
+end
+local size = redis.call('INCRBY', KEYS[2], ARGV[3])
+redis.call('XADD', KEYS[1], size .. '-0', 'data', ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+redis.call('EXPIRE', KEYS[2], ARGV[2])
+redis.call('EXPIRE', KEYS[4], ARGV[2])
+redis.call('EXPIRE', KEYS[5], ARGV[2])
+redis.call('EXPIRE', KEYS[6], ARGV[2])
+redis.call('DEL', KEYS[3])
+return size
+`)
+
+// Appends a marker entry (`eof` when the stream is done, `kill` when
+// it's being deleted) so blocked readers wake up. The entry shares
+// the end offset of the last write, using the next free sequence
+// number. Returns 0 when the channel isn't registered.
+//
+// A kill deletes the channel's keys along with it. Blocked readers
+// are only served once the script returns, so the stream itself is
+// left to expire after ARGV[1] seconds for them to see the entry.
+//
+// KEYS: stream, size, done, ttl, key, type, truncated, subscribers
+// ARGV: expire, marker
+var streamMarkScript = redis.NewScript(8, `
+local size = redis.call('GET', KEYS[2])
+if not size then
+  return 0
+end
+local seq = 1
+local last = redis.call('XREVRANGE', KEYS[1], '+', '-', 'COUNT', 1)
+if last[1] then
+  local ms, s = string.match(last[1][1], '(%d+)-(%d+)')
+  if ms == size then
+    seq = tonumber(s) + 1
+  end
+end
+redis.call('XADD', KEYS[1], size .. '-' .. seq, ARGV[2], 1)
+if ARGV[2] == 'eof' then
+  redis.call('EXPIRE', KEYS[1], ARGV[1])
+  redis.call('EXPIRE', KEYS[2], ARGV[1])
+  redis.call('EXPIRE', KEYS[4], ARGV[1])
+  redis.call('EXPIRE', KEYS[5], ARGV[1])
+  redis.call('EXPIRE', KEYS[6], ARGV[1])
+  redis.call('SETEX', KEYS[3], ARGV[1], 1)
+else
+  redis.call('DEL', KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6], KEYS[7], KEYS[8])
+  redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// Seconds a killed stream is kept for blocked readers.
+const streamKillGrace = 5
+
+func (c channel) streamId() string {
+	return string(c) + ":stream"
+}
+
+func (c channel) sizeId() string {
+	return string(c) + ":size"
+}
+
+// Runs streamMarkScript on the channel.
+func markStream(conn redis.Conn, c channel, expire int64, marker string) error {
+	ok, err := redis.Bool(streamMarkScript.Do(conn,
+		c.streamId(), c.sizeId(), c.doneId(), c.ttlId(), c.keyId(), c.typeId(), c.truncatedId(), c.subscribersId(),
+		expire, marker))
+	if err == nil && !ok {
+		err = ErrNotRegistered
+	}
+	return err
+}
+
+// RedisStreamsBroker stores each write as an entry of a redis
+// stream (XADD), and readers block on XREAD from the last entry
+// they've seen instead of refetching on every notification.
+// On encrypted channels, each entry is sealed on its own.
+type RedisStreamsBroker struct {
+	pool *redis.Pool
+}
+
+func NewRedisStreamsBroker(server *url.URL) *RedisStreamsBroker {
+	return &RedisStreamsBroker{pool: newPool(server)}
+}
+
+func (b *RedisStreamsBroker) Register(channelName string, ttl time.Duration) error {
+	return b.RegisterWithType(channelName, ttl, "")
+}
+
+func (b *RedisStreamsBroker) RegisterWithType(channelName string, ttl time.Duration, contentType string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := channel(channelName)
+	expire := expireSeconds(streamTTL(ttl))
+
+	envelope, err := newChannelKey()
+	if err != nil {
+		util.CountWithData("RedisStreamsBroker.Register.error", 1, "error=%s", err)
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", channel.streamId(), channel.doneId(), channel.truncatedId())
+	conn.Send("SETEX", channel.sizeId(), expire, 0)
+	conn.Send("SETEX", channel.ttlId(), expire, expire)
+	sendChannelKey(conn, channel, expire, envelope)
+	sendChannelType(conn, channel, expire, contentType)
+
+	if _, err := conn.Do("EXEC"); err != nil {
+		util.CountWithData("RedisStreamsBroker.Register.error", 1, "error=%s", err)
+		return err
+	}
+	return nil
+}
+
+func (b *RedisStreamsBroker) IsRegistered(channelName string) bool {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", channel(channelName).sizeId()))
+	if err != nil {
+		util.CountWithData("RedisStreamsBroker.IsRegistered.error", 1, "error=%s", err)
+		return false
+	}
+	return exists
+}
+
+func (b *RedisStreamsBroker) Unregister(channelName string) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	return markStream(conn, channel(channelName), streamKillGrace, "kill")
+}
+
+func (b *RedisStreamsBroker) Status(channelName string) (*Status, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := channel(channelName)
+
+	conn.Send("MULTI")
+	conn.Send("EXISTS", channel.sizeId())
+	conn.Send("GET", channel.sizeId())
+	conn.Send("EXISTS", channel.doneId())
+	conn.Send("EXISTS", channel.truncatedId())
+	conn.Send("PTTL", channel.sizeId())
+	conn.Send("GET", channel.subscribersId())
+	conn.Send("GET", channel.typeId())
+
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	if exists, _ := redis.Bool(list[0], nil); !exists {
+		return nil, ErrNotRegistered
+	}
+
+	status := &Status{}
+	status.Size, _ = redis.Int64(list[1], nil)
+	status.Done, _ = redis.Bool(list[2], nil)
+	status.Truncated, _ = redis.Bool(list[3], nil)
+	ttl, _ := redis.Int64(list[4], nil)
+	status.TTL = pttl(ttl)
+	count, _ := redis.Int64(list[5], nil)
+	status.Subscribers = subscribers(count)
+	status.ContentType, _ = redis.String(list[6], nil)
+
+	return status, nil
+}
+
+func (b *RedisStreamsBroker) Get(key string) ([]byte, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	entries, err := redis.Values(conn.Do("XRANGE", channel(key).streamId(), "-", "+"))
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := channelKey(conn, channel(key))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0)
+	for _, e := range entries {
+		entry, err := parseStreamEntry(e)
+		if err == nil {
+			err = entry.open(dataKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, entry.data...)
+	}
+	return buf, nil
+}
+
+func (b *RedisStreamsBroker) NewWriter(key string) (io.WriteCloser, error) {
+	if !b.IsRegistered(key) {
+		return nil, ErrNotRegistered
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+	dataKey, err := channelKey(conn, channel)
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{b.pool, channel, channelExpire(conn, channel), dataKey}, nil
+}
+
+func (b *RedisStreamsBroker) NewReader(key string) (io.ReadCloser, error) {
+	if !b.IsRegistered(key) {
+		return nil, ErrNotRegistered
+	}
+
+	// Readers block on XREAD, so they get a dedicated
+	// connection which is torn down on Close.
+	conn, err := b.pool.Dial()
+	if err != nil {
+		return nil, err
+	}
+
+	channel := channel(key)
+	dataKey, err := channelKey(conn, channel)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	expire := channelExpire(conn, channel)
+	subscribe(conn, channel, expire)
+
+	return &streamReader{
+		pool:    b.pool,
+		conn:    conn,
+		channel: channel,
+		expire:  expire,
+		key:     dataKey,
+		mutex:   &sync.Mutex{}}, nil
+}
+
+func (b *RedisStreamsBroker) ReaderDone(rd io.Reader) bool {
+	r, ok := rd.(*streamReader)
+	if !ok {
+		return false
+	}
+
+	if r.closed {
+		return true
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	done, _ := redis.Bool(conn.Do("EXISTS", r.channel.doneId()))
+	return done
+}
+
+func (b *RedisStreamsBroker) NoContent(rd io.Reader, offset int64) bool {
+	if !b.ReaderDone(rd) {
+		return false
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	size, err := redis.Int64(conn.Do("GET", rd.(*streamReader).channel.sizeId()))
+	if err != nil {
+		return false
+	}
+
+	return offset > (size - 1)
+}
+
+func (b *RedisStreamsBroker) RenewExpiry(rd io.Reader) {
+	r, ok := rd.(*streamReader)
+	if !ok {
+		return
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("EXPIRE", r.channel.streamId(), r.expire)
+	conn.Send("EXPIRE", r.channel.sizeId(), r.expire)
+	conn.Send("EXPIRE", r.channel.ttlId(), r.expire)
+	conn.Send("EXPIRE", r.channel.keyId(), r.expire)
+	conn.Send("EXPIRE", r.channel.typeId(), r.expire)
+	conn.Send("EXPIRE", r.channel.subscribersId(), r.expire)
+	conn.Do("EXEC")
+}
+
+type streamWriter struct {
+	pool    *redis.Pool
+	channel channel
+	expire  int64
+	key     *crypt.DataKey // nil for plaintext channels
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	// Entry IDs are derived from the stream size, so an
+	// empty write would collide with the previous entry.
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	conn := w.pool.Get()
+	defer conn.Close()
+
+	data, truncated, err := w.limit(conn, p)
+	if err != nil {
+		return 0, err
+	}
+
+	if truncated {
+		conn.Do("SETEX", w.channel.truncatedId(), w.expire, 1)
+	}
+
+	// Dropped writes on a truncated stream.
+	if len(data) == 0 {
+		return len(p), nil
+	}
+
+	if err := w.append(conn, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Number of times a sealed entry is sealed again, when
+// another writer got in first.
+const streamSealRetries = 5
+
+var errStreamRace = errors.New("stream: too many concurrent writers")
+
+func (w *streamWriter) append(conn redis.Conn, data []byte) error {
+	for i := 0; i < streamSealRetries; i++ {
+		entry, expected := data, int64(-1)
+
+		// Entries are sealed with the end offset of their
+		// ID, so they can't be moved around in the stream.
+		if w.key != nil {
+			size, err := redis.Int64(conn.Do("GET", w.channel.sizeId()))
+			if err == redis.ErrNil {
+				return ErrNotRegistered
+			}
+			if err != nil {
+				return err
+			}
+			entry, expected = w.key.Seal(size+int64(len(data)), data), size
+		}
+
+		size, err := redis.Int64(streamWriteScript.Do(conn,
+			w.channel.streamId(), w.channel.sizeId(), w.channel.doneId(), w.channel.ttlId(), w.channel.keyId(), w.channel.typeId(),
+			entry, w.expire, len(data), expected))
+		if err != nil {
+			return err
+		}
+		switch size {
+		case -1:
+			return ErrNotRegistered
+		case -2:
+			util.Count("RedisStreamsBroker.write.reseal")
+			continue
+		}
+		return nil
+	}
+	return errStreamRace
+}
+
+// Caps p to the max stream size. As with the string based
+// broker, the size check isn't atomic with the write.
+func (w *streamWriter) limit(conn redis.Conn, p []byte) ([]byte, bool, error) {
+	if *util.MaxStreamSize <= 0 {
+		return p, false, nil
+	}
+
+	size, err := redis.Int64(conn.Do("GET", w.channel.sizeId()))
+	if err != nil && err != redis.ErrNil {
+		return nil, false, err
+	}
+	return limit(string(w.channel), size, p)
+}
+
+func (w *streamWriter) Close() error {
+	conn := w.pool.Get()
+	defer conn.Close()
+
+	return markStream(conn, w.channel, w.expire, "eof")
+}
+
+type streamReader struct {
+	pool    *redis.Pool
+	conn    redis.Conn
+	channel channel
+	expire  int64
+	offset  int64   // offset of the next byte to be read
+	lastId  string  // last entry ID read from the stream
+	pending []byte  // data read but not yet returned
+	entries []entry // entries fetched but not yet consumed
+	started bool
+	closed  bool
+	key     *crypt.DataKey // nil for plaintext channels
+	mutex   *sync.Mutex
+}
+
+type entry struct {
+	end  int64 // offset right after this entry's data
+	data []byte
+	eof  bool
+	kill bool
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return 0, errWhence
+	case 0:
+		r.offset = offset
+	case 1:
+		r.offset += offset
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+
+	// Entries are keyed by their end offset, so the first
+	// entry after `<offset>-0` holds the byte at offset.
+	r.lastId = fmt.Sprintf("%d-0", r.offset)
+	r.pending = nil
+	r.entries = nil
+
+	return r.offset, nil
+}
+
+func (r *streamReader) Read(p []byte) (n int, err error) {
+	if r.closed { // Don't read from a closed redigo connection
+		return 0, io.EOF
+	}
+
+	if !r.started {
+		r.started = true
+
+		// A reader positioned at or past the end of a done
+		// channel would otherwise block forever on XREAD.
+		if r.done() && r.offset >= r.size() {
+			r.Close()
+			return 0, io.EOF
+		}
+	}
+
+	for len(r.pending) == 0 {
+		if len(r.entries) == 0 {
+			if r.entries, err = r.fetch(); err != nil {
+				if r.closed {
+					return 0, io.EOF
+				}
+				util.CountWithData("RedisStreamsBroker.read.error", 1, "err=%s", err)
+				return 0, err
+			}
+			continue
+		}
+
+		e := r.entries[0]
+		r.entries = r.entries[1:]
+
+		if e.kill {
+			util.Count("RedisStreamsBroker.read.channelKill")
+			r.Close()
+			return 0, io.EOF
+		}
+
+		if e.eof {
+			// Only stop if the channel hasn't been
+			// reopened by a later write.
+			if r.done() {
+				util.Count("RedisStreamsBroker.read.channelDone")
+				r.Close()
+				return 0, io.EOF
+			}
+			continue
+		}
+
+		// Skip the part of the entry before our offset.
+		start := e.end - int64(len(e.data))
+		if skip := r.offset - start; skip > 0 {
+			if skip >= int64(len(e.data)) {
+				continue
+			}
+			e.data = e.data[skip:]
+		}
+		r.pending = e.data
+		r.offset = e.end
+	}
+
+	n = copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Blocks until there are new entries after lastId.
+func (r *streamReader) fetch() ([]entry, error) {
+	if r.lastId == "" {
+		r.lastId = "0-0"
+	}
+
+	reply, err := redis.Values(r.conn.Do("XREAD",
+		"COUNT", streamReadCount, "BLOCK", 0,
+		"STREAMS", r.channel.streamId(), r.lastId))
+	if err != nil {
+		return nil, err
+	}
+
+	// reply: [[stream, [[id, [field, value, ...]], ...]]]
+	var entries []entry
+	for _, s := range reply {
+		stream, err := redis.Values(s, nil)
+		if err != nil || len(stream) != 2 {
+			return nil, errStreamReply
+		}
+
+		list, err := redis.Values(stream[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range list {
+			e, err := parseStreamEntry(item)
+			if err == nil {
+				err = e.open(r.key)
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e.entry)
+			r.lastId = e.id
+		}
+	}
+	return entries, nil
+}
+
+func (r *streamReader) done() bool {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	done, _ := redis.Bool(conn.Do("EXISTS", r.channel.doneId()))
+	return done
+}
+
+func (r *streamReader) size() int64 {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	size, _ := redis.Int64(conn.Do("GET", r.channel.sizeId()))
+	return size
+}
+
+func (r *streamReader) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+	unsubscribe(conn, r.channel, r.expire)
+
+	r.closed = true
+	return r.conn.Close()
+}
+
+type streamEntry struct {
+	entry
+	id string
+}
+
+// Opens the data of an entry sealed with key. Entries are
+// sealed as the chunk at the end offset of their ID.
+func (e *streamEntry) open(key *crypt.DataKey) (err error) {
+	if key != nil && e.data != nil {
+		e.data, err = key.Open(e.end, e.data)
+	}
+	return err
+}
+
+var errStreamReply = errors.New("unexpected stream reply")
+
+// Parses a single `[id, [field, value, ...]]` stream entry.
+func parseStreamEntry(reply interface{}) (e streamEntry, err error) {
+	item, err := redis.Values(reply, nil)
+	if err != nil || len(item) != 2 {
+		return e, errStreamReply
+	}
+
+	if e.id, err = redis.String(item[0], nil); err != nil {
+		return e, err
+	}
+
+	fields, err := redis.Values(item[1], nil)
+	if err != nil {
+		return e, err
+	}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := redis.String(fields[i], nil)
+		switch name {
+		case "data":
+			e.data, err = redis.Bytes(fields[i+1], nil)
+		case "eof":
+			e.eof = true
+		case "kill":
+			e.kill = true
+		}
+	}
+
+	// The ID has the form `<end offset>-<seq>`.
+	end := strings.SplitN(e.id, "-", 2)[0]
+	e.end, _ = strconv.ParseInt(end, 10, 64)
+
+	return e, err
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/heroku/busl/crypt"
+	"github.com/heroku/busl/util"
+)
+
+func newStreamsReaderWriter() (*RedisStreamsBroker, string) {
+	server, _ := url.Parse(*redisUrl)
+	b := NewRedisStreamsBroker(server)
+	uuid, _ := util.NewUUID()
+	b.Register(uuid, 0)
+
+	return b, uuid
+}
+
+func TestStreamsPubSub(t *testing.T) {
+	b, uuid := newStreamsReaderWriter()
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+
+	done := make(chan []byte)
+	go func() {
+		buf, _ := ioutil.ReadAll(r)
+		done <- buf
+	}()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	assert.Equal(t, "busl hello world", string(<-done))
+}
+
+func TestStreamsSeek(t *testing.T) {
+	b, uuid := newStreamsReaderWriter()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("busl"))
+	w.Write([]byte(" hello"))
+	w.Write([]byte(" world"))
+	w.Close()
+
+	for offset, expected := range map[int64]string{
+		0:  "busl hello world",
+		2:  "sl hello world",
+		4:  " hello world",
+		10: " world",
+		16: "",
+		20: "",
+	} {
+		r, _ := b.NewReader(uuid)
+		r.(io.Seeker).Seek(offset, 0)
+
+		buf, _ := ioutil.ReadAll(r)
+		assert.Equal(t, expected, string(buf))
+		r.Close()
+	}
+}
+
+func TestStreamsGetAndDone(t *testing.T) {
+	b, uuid := newStreamsReaderWriter()
+
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	buf, err := b.Get(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	r, _ := b.NewReader(uuid)
+	defer r.Close()
+	assert.False(t, b.ReaderDone(r))
+
+	w.Close()
+	assert.True(t, b.ReaderDone(r))
+	assert.False(t, b.NoContent(r, 4))
+	assert.True(t, b.NoContent(r, 5))
+}
+
+func TestStreamsEncryptedEntriesBound(t *testing.T) {
+	*util.EncryptionKeys = "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	defer func() {
+		*util.EncryptionKeys = ""
+	}()
+
+	b, uuid := newStreamsReaderWriter()
+	w, _ := b.NewWriter(uuid)
+	w.Write([]byte("hello"))
+
+	// Replaying an entry further down the stream.
+	conn := b.pool.Get()
+	defer conn.Close()
+	entries, _ := redis.Values(conn.Do("XRANGE", channel(uuid).streamId(), "-", "+"))
+	entry, _ := parseStreamEntry(entries[0])
+	conn.Do("XADD", channel(uuid).streamId(), "10-0", "data", entry.data)
+	conn.Do("INCRBY", channel(uuid).sizeId(), 5)
+
+	_, err := b.Get(uuid)
+	assert.Equal(t, crypt.ErrCorrupt, err)
+}
@@ -1,14 +1,20 @@
 package broker
 
 import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/garyburd/redigo/redis"
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/heroku/busl/crypt"
 	"github.com/heroku/busl/util"
 )
 
-func newRegUUID() (*RedisRegistrar, string) {
-	reg := NewRedisRegistrar()
+func newRegUUID() (Registrar, string) {
+	reg := Default()
 	uuid, _ := util.NewUUID()
 
 	return reg, uuid
@@ -16,7 +22,7 @@ func newRegUUID() (*RedisRegistrar, string) {
 
 func TestRegisteredIsRegistered(t *testing.T) {
 	reg, uuid := newRegUUID()
-	reg.Register(uuid)
+	reg.Register(uuid, 0)
 	assert.True(t, reg.IsRegistered(uuid))
 }
 
@@ -37,10 +43,136 @@ func TestUnregisteredErrNotRegistered(t *testing.T) {
 
 func TestRegisteredNoError(t *testing.T) {
 	reg, uuid := newRegUUID()
-	reg.Register(uuid)
+	reg.Register(uuid, 0)
 	_, err := NewReader(uuid)
 	assert.Nil(t, err)
 
 	_, err = NewWriter(uuid)
 	assert.Nil(t, err)
 }
+
+func TestChannelContentType(t *testing.T) {
+	server, _ := url.Parse(*redisUrl)
+
+	for _, b := range []Broker{NewRedisBroker(server), NewRedisStreamsBroker(server)} {
+		uuid, _ := util.NewUUID()
+		b.RegisterWithType(uuid, 0, "application/x-ndjson")
+
+		status, err := b.Status(uuid)
+		assert.Nil(t, err)
+		assert.Equal(t, "application/x-ndjson", status.ContentType)
+
+		b.Register(uuid, 0)
+		status, _ = b.Status(uuid)
+		assert.Equal(t, "", status.ContentType)
+	}
+}
+
+func TestUnregisterStopsWriters(t *testing.T) {
+	server, _ := url.Parse(*redisUrl)
+
+	for _, b := range []Broker{NewRedisBroker(server), NewRedisStreamsBroker(server)} {
+		uuid, _ := util.NewUUID()
+		b.Register(uuid, 0)
+
+		w, _ := b.NewWriter(uuid)
+		w.Write([]byte("hello"))
+
+		assert.Nil(t, b.Unregister(uuid))
+		assert.Equal(t, ErrNotRegistered, b.Unregister(uuid))
+
+		_, err := w.Write([]byte(" world"))
+		assert.Equal(t, ErrNotRegistered, err)
+		assert.Equal(t, ErrNotRegistered, w.Close())
+		assert.False(t, b.IsRegistered(uuid))
+	}
+}
+
+func TestUnsubscribeAfterUnregister(t *testing.T) {
+	server, _ := url.Parse(*redisUrl)
+	conn := newPool(server).Get()
+	defer conn.Close()
+
+	for _, b := range []Broker{NewRedisBroker(server), NewRedisStreamsBroker(server)} {
+		uuid, _ := util.NewUUID()
+		b.Register(uuid, 0)
+
+		rd, err := b.NewReader(uuid)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Unregister(uuid))
+		rd.Close()
+
+		// The counter isn't left behind without an expiry.
+		exists, _ := redis.Bool(conn.Do("EXISTS", channel(uuid).subscribersId()))
+		assert.False(t, exists)
+	}
+}
+
+func TestEncryptedChannels(t *testing.T) {
+	*util.EncryptionKeys = "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	defer func() {
+		*util.EncryptionKeys = ""
+	}()
+
+	server, _ := url.Parse(*redisUrl)
+	data := strings.Repeat("busl", crypt.ChunkSize)
+
+	for _, b := range []Broker{NewRedisBroker(server), NewRedisStreamsBroker(server)} {
+		uuid, _ := util.NewUUID()
+		b.Register(uuid, 0)
+
+		// Writes straddle chunk boundaries.
+		w, _ := b.NewWriter(uuid)
+		w.Write([]byte(data[:10]))
+		w.Write([]byte(data[10:5000]))
+		w.Write([]byte(data[5000:]))
+		w.Close()
+
+		status, err := b.Status(uuid)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), status.Size)
+
+		stored, err := b.Get(uuid)
+		assert.Nil(t, err)
+		assert.Equal(t, data, string(stored))
+
+		r, _ := b.NewReader(uuid)
+		r.(io.Seeker).Seek(6000, 0)
+		buf, err := ioutil.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, data[6000:], string(buf))
+	}
+}
+
+func TestOpenRange(t *testing.T) {
+	*util.EncryptionKeys = "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	defer func() {
+		*util.EncryptionKeys = ""
+	}()
+
+	key, _ := crypt.NewDataKey()
+	data := strings.Repeat("busl", crypt.ChunkSize)
+	sealed := key.SealChunks(0, []byte(data))
+
+	for _, r := range [][2]int64{{0, 10}, {10, 5000}, {4095, 4097}, {8192, 20000}, {16384, 16400}} {
+		first := r[0] / crypt.ChunkSize * crypt.SlotSize
+		last := (r[1] + crypt.ChunkSize - 1) / crypt.ChunkSize * crypt.SlotSize
+		if last > int64(len(sealed)) {
+			last = int64(len(sealed))
+		}
+
+		plain, err := openRange(key, sealed[first:last], r[0], r[1])
+		assert.Nil(t, err)
+
+		end := r[1]
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if r[0] >= end {
+			assert.Empty(t, plain)
+		} else {
+			assert.Equal(t, data[r[0]:end], string(plain))
+		}
+	}
+}
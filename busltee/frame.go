@@ -0,0 +1,84 @@
+package busltee
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+// A chunk of the command's output in framed mode, sent as
+// one NDJSON record.
+type frame struct {
+	Source string `json:"source"`
+	Time   string `json:"time"`
+	Data   string `json:"data"`
+}
+
+// Frames the output of stdout and stderr into records telling
+// them apart, written to w. w is closed once both are.
+type framedOutput struct {
+	w     io.WriteCloser
+	mutex sync.Mutex
+	open  int
+}
+
+func newFramedOutput(w io.WriteCloser) (stdout, stderr io.WriteCloser) {
+	out := &framedOutput{w: w, open: 2}
+	return &framer{out: out, source: "stdout"}, &framer{out: out, source: "stderr"}
+}
+
+type framer struct {
+	out    *framedOutput
+	source string
+	held   []byte // incomplete UTF-8 sequence ending the last write
+}
+
+func (f *framer) Write(p []byte) (int, error) {
+	// A rune split across writes would be mangled in
+	// both records, so it waits for the next write.
+	data, rest := util.SplitUTF8(append(f.held, p...))
+	f.held = append([]byte(nil), rest...)
+
+	if err := f.write(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *framer) write(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	record, err := json.Marshal(frame{
+		Source: f.source,
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Data:   string(data),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Records are written whole, so those of stdout
+	// and stderr don't interleave.
+	_, err = f.out.w.Write(append(record, '\n'))
+	return err
+}
+
+func (f *framer) Close() error {
+	err := f.write(f.held)
+	f.held = nil
+
+	f.out.mutex.Lock()
+	defer f.out.mutex.Unlock()
+
+	if f.out.open--; f.out.open == 0 {
+		if cerr := f.out.w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package busltee
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Timestamps of prefixed lines, with milliseconds.
+const rfc3339Millis = "2006-01-02T15:04:05.000Z07:00"
+
+// Prefixes lines of output with a timestamp and a label.
+type prefixer struct {
+	timestamps string // "rfc3339", "elapsed", or "" for none
+	label      string
+	start      time.Time
+}
+
+// Returns the prefixer for conf, nil when it asks for
+// neither timestamps nor a label.
+func newPrefixer(conf *Config) *prefixer {
+	if conf.Timestamps == "" && conf.Label == "" {
+		return nil
+	}
+	return &prefixer{timestamps: conf.Timestamps, label: conf.Label, start: time.Now()}
+}
+
+func (p *prefixer) prefix() []byte {
+	var prefix []byte
+
+	switch p.timestamps {
+	case "rfc3339":
+		prefix = append(prefix, time.Now().UTC().Format(rfc3339Millis)+" "...)
+	case "elapsed":
+		prefix = append(prefix, formatElapsed(time.Since(p.start))+" "...)
+	}
+
+	if p.label != "" {
+		prefix = append(prefix, "["+p.label+"] "...)
+	}
+	return prefix
+}
+
+// Formats d as hh:mm:ss.mmm.
+func formatElapsed(d time.Duration) string {
+	ms := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+type prefixWriter struct {
+	p         *prefixer
+	w         io.WriteCloser
+	lineStart bool // the next byte starts a line
+	afterCR   bool // the last byte was a \r
+}
+
+// Wraps w so every line written to it gets prefixed, once its
+// first byte is written. Lines redrawn after a \r (e.g. progress
+// bars) are prefixed again, while \r\n is a single line break.
+func (p *prefixer) NewWriter(w io.WriteCloser) io.WriteCloser {
+	return &prefixWriter{p: p, w: w, lineStart: true}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	var prefix []byte
+	buf := make([]byte, 0, len(p))
+
+	for _, c := range p {
+		if w.lineStart && !(w.afterCR && c == '\n') {
+			if prefix == nil {
+				prefix = w.p.prefix()
+			}
+			buf = append(buf, prefix...)
+			w.lineStart = false
+		}
+
+		buf = append(buf, c)
+		if c == '\n' || c == '\r' {
+			w.lineStart = true
+		}
+		w.afterCR = c == '\r'
+	}
+
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *prefixWriter) Close() error {
+	return w.w.Close()
+}
@@ -1,8 +1,10 @@
 package busltee
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -11,35 +13,70 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
 
 type Config struct {
-	Insecure  bool
-	Timeout   float64
-	Retry     int
-	URL       string
-	Args      []string
-	LogPrefix string
-	LogFile   string
+	Insecure       bool
+	Timeout        float64
+	Retry          int
+	URL            string
+	Args           []string
+	LogPrefix      string
+	LogFile        string
+	SpoolFile      string
+	SpoolDeadline  float64
+	UploadDeadline float64
+	Framed         bool
+	Timestamps     string
+	Label          string
+	PrefixLocal    bool
 }
 
 func Run(url string, args []string, conf *Config) (exitCode int) {
 	defer monitor("busltee.busltee", time.Now())
 
-	reader, writer := io.Pipe()
-	done := post(url, reader, conf)
+	output := newSpool()
+	if conf.SpoolFile != "" {
+		var err error
+		if output, err = newFileSpool(conf.SpoolFile); err != nil {
+			log.Printf("count#busltee.spool.error=1 error=%v", err.Error())
+			output = newSpool()
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := post(ctx, url, output, conf)
 
-	if err := run(args, writer, writer); err != nil {
+	stdout, stderr := outputs(output, conf)
+	if err := run(args, stdout, stderr); err != nil {
 		log.Printf("count#busltee.exec.error=1 error=%v", err.Error())
 		exitCode = exitStatus(err)
 	}
 
+	// The upload may lag behind, or be resuming.
+	var deadline <-chan time.Time
+	if conf.UploadDeadline > 0 {
+		deadline = time.After(time.Duration(conf.UploadDeadline * float64(time.Second)))
+	}
+
+	var err error
 	select {
-	case <-done:
-	case <-time.After(time.Second):
+	case err = <-done:
+	case <-deadline:
 		log.Printf("count#busltee.exec.upload.timeout=1")
+
+		// Stopped before the spool file gets uploaded, so
+		// the two uploads don't interleave.
+		cancel()
+		<-done
+		err = errUploadTimeout
+	}
+
+	if err != nil && output.onDisk() {
+		uploadSpool(url, output.committed(), conf)
 	}
 
 	return exitCode
@@ -49,26 +86,72 @@ func monitor(subject string, ts time.Time) {
 	log.Printf("%s.time time=%f", subject, time.Now().Sub(ts).Seconds())
 }
 
-func post(url string, reader io.Reader, conf *Config) chan struct{} {
-	done := make(chan struct{})
+func post(ctx context.Context, url string, output *spool, conf *Config) chan error {
+	done := make(chan error, 1)
 
 	go func() {
-		if err := stream(url, reader, conf); err != nil {
+		err := stream(ctx, url, output, conf)
+		if err != nil {
 			log.Printf("count#busltee.stream.error=1 error=%v", err.Error())
-			// Prevent writes from blocking.
-			io.Copy(ioutil.Discard, reader)
+
+			// Nothing resumes the upload anymore.
+			output.abandon()
 		} else {
 			log.Printf("count#busltee.stream.success=1")
 		}
-		close(done)
+		done <- err
 	}()
 
 	return done
 }
 
-func stream(url string, stdin io.Reader, conf *Config) (err error) {
+// Delay before resuming a broken upload.
+var resumeDelay = time.Second
+
+// Uploads the output, retrying connect timeouts. Once some of
+// the output went through, a broken upload is resumed from what
+// busl committed, sent along with its offset for busl to skip
+// what it already has, as long as the spool still holds it.
+// Cancelling ctx stops the upload.
+func stream(ctx context.Context, url string, output *spool, conf *Config) (err error) {
+	started := false
+
 	for retries := conf.Retry; retries >= 0; retries-- {
-		if err = streamNoRetry(url, stdin, conf); !isTimeout(err) {
+		from, offset := output.committed(), int64(-1)
+		if started {
+			select {
+			case <-time.After(resumeDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			from = output.committed()
+			offset = from
+			if !output.holds(from) {
+				return errSpoolTrimmed
+			}
+			log.Printf("count#busltee.stream.resume=1 offset=%d", offset)
+		}
+
+		stdin := output.NewReader(from)
+		stop := trimCommitted(url, output, conf)
+		var committed int64
+		committed, err = streamFrom(ctx, url, stdin, offset, conf)
+		stop()
+		output.commit(committed)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// An upload that got some output through doesn't use
+		// up a retry.
+		if stdin.Offset() > from {
+			started = true
+			retries = conf.Retry + 1
+		}
+		if !started && !isTimeout(err) && !isServerError(err) {
 			return err
 		}
 		log.Printf("count#busltee.stream.retry")
@@ -76,14 +159,95 @@ func stream(url string, stdin io.Reader, conf *Config) (err error) {
 	return err
 }
 
-var errMissingURL = errors.New("Missing URL")
+// First delay between uploads of the spool file, doubled
+// after each failure.
+var spoolBackoff = time.Second
+
+// Uploads the spool file once the command exited, until it
+// succeeds or the deadline would pass. The file is sent from
+// offset, what busl is known to have committed, and busl
+// skips whatever else it already has.
+func uploadSpool(url string, offset int64, conf *Config) error {
+	defer monitor("busltee.spool.upload", time.Now())
+
+	deadline := time.Now().Add(time.Duration(conf.SpoolDeadline * float64(time.Second)))
+
+	for delay := spoolBackoff; ; delay *= 2 {
+		err := uploadSpoolNoRetry(url, offset, conf)
+		if err == nil {
+			log.Printf("count#busltee.spool.upload.success=1")
+			return nil
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			log.Printf("count#busltee.spool.upload.error=1 error=%v", err.Error())
+			return err
+		}
+		log.Printf("count#busltee.spool.upload.retry=1 error=%v", err.Error())
+		time.Sleep(delay)
+	}
+}
+
+func uploadSpoolNoRetry(url string, offset int64, conf *Config) error {
+	if url == "" {
+		return errMissingURL
+	}
+
+	file, err := os.Open(conf.SpoolFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, ioutil.NopCloser(file))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Stream-Offset", strconv.FormatInt(offset, 10))
+
+	res, err := newTransport(conf).RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return &statusError{res.StatusCode}
+	}
+	return nil
+}
+
+var (
+	errMissingURL    = errors.New("Missing URL")
+	errUploadTimeout = errors.New("Upload still running after the command exited")
+)
+
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Unexpected status %d", e.code)
+}
 
 func streamNoRetry(url string, stdin io.Reader, conf *Config) error {
+	_, err := streamFrom(context.Background(), url, stdin, -1, conf)
+	return err
+}
+
+// Uploads stdin as the output from offset on, appending it
+// to the stream when offset is -1. Returns how much of the
+// stream busl reported as committed, -1 if it didn't.
+func streamFrom(ctx context.Context, url string, stdin io.Reader, offset int64, conf *Config) (int64, error) {
 	defer monitor("busltee.stream", time.Now())
 
 	if url == "" {
 		log.Printf("count#busltee.stream.missingurl")
-		return errMissingURL
+		return -1, errMissingURL
 	}
 
 	tr := newTransport(conf)
@@ -95,14 +259,81 @@ func streamNoRetry(url string, stdin io.Reader, conf *Config) error {
 	// on the other end of the pipe to work).
 	req, err := http.NewRequest("POST", url, ioutil.NopCloser(stdin))
 	if err != nil {
-		return err
+		return -1, err
+	}
+	req = req.WithContext(ctx)
+	if offset >= 0 {
+		req.Header.Set("Stream-Offset", strconv.FormatInt(offset, 10))
 	}
 
 	res, err := tr.RoundTrip(req)
-	if res != nil {
-		defer res.Body.Close()
+	if err != nil {
+		return -1, err
 	}
-	return err
+	defer res.Body.Close()
+
+	committed, err := strconv.ParseInt(res.Header.Get("Stream-Committed-Length"), 10, 64)
+	if err != nil {
+		committed = -1
+	}
+
+	if res.StatusCode >= 500 {
+		return committed, &statusError{res.StatusCode}
+	}
+	return committed, nil
+}
+
+// Interval between checks of how much of the output busl
+// committed while it's being uploaded.
+var commitInterval = 10 * time.Second
+
+// Keeps dropping the output busl committed from the spool,
+// until the returned func is called, which returns once the
+// checks stopped.
+func trimCommitted(url string, output *spool, conf *Config) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	interval := commitInterval
+
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+
+			if offset, err := committedOffset(ctx, url, conf); err == nil {
+				output.commit(offset)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// Asks busl how much of the stream it has.
+func committedOffset(ctx context.Context, url string, conf *Config) (int64, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := newTransport(conf).RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.ContentLength < 0 {
+		return 0, &statusError{res.StatusCode}
+	}
+	return res.ContentLength, nil
 }
 
 func newTransport(conf *Config) *http.Transport {
@@ -122,14 +353,45 @@ func newTransport(conf *Config) *http.Transport {
 	return tr
 }
 
+// Returns the writers for the command's stdout and stderr,
+// streaming the output while echoing it locally. Framed output
+// tells stdout and stderr apart. Lines are only prefixed in the
+// stream, unless conf asks for it locally as well.
+func outputs(output io.WriteCloser, conf *Config) (stdout, stderr io.WriteCloser) {
+	stdout, stderr = output, output
+	if conf.Framed {
+		stdout, stderr = newFramedOutput(output)
+	}
+
+	prefixer := newPrefixer(conf)
+	switch {
+	case prefixer == nil:
+		return tee(stdout, os.Stdout), tee(stderr, os.Stderr)
+	case conf.PrefixLocal:
+		return prefixer.NewWriter(tee(stdout, os.Stdout)), prefixer.NewWriter(tee(stderr, os.Stderr))
+	default:
+		return tee(prefixer.NewWriter(stdout), os.Stdout), tee(prefixer.NewWriter(stderr), os.Stderr)
+	}
+}
+
+type teeWriter struct {
+	io.Writer
+	io.Closer
+}
+
+// Returns a writer to both w and local, closing only w.
+func tee(w io.WriteCloser, local io.Writer) io.WriteCloser {
+	return &teeWriter{io.MultiWriter(w, local), w}
+}
+
 func run(args []string, stdout, stderr io.WriteCloser) error {
 	defer stdout.Close()
 	defer stderr.Close()
 	defer monitor("busltee.run", time.Now())
 
 	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = io.MultiWriter(stdout, os.Stdout)
-	cmd.Stderr = io.MultiWriter(stderr, os.Stderr)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	if err := cmd.Start(); err != nil {
 		return err
@@ -154,6 +416,11 @@ func isTimeout(err error) bool {
 	return ok && e.Timeout()
 }
 
+func isServerError(err error) bool {
+	e, ok := err.(*statusError)
+	return ok && e.code >= 500
+}
+
 func exitStatus(err error) int {
 	if exit, ok := err.(*exec.ExitError); ok {
 		if status, ok := exit.Sys().(syscall.WaitStatus); ok {
@@ -2,11 +2,18 @@ package busltee
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -112,6 +119,460 @@ func TestRun(t *testing.T) {
 
 }
 
+func TestStreamResume(t *testing.T) {
+	defer func(delay time.Duration) { resumeDelay = delay }(resumeDelay)
+	resumeDelay = 0
+
+	var committed []byte
+	var offsets []string
+	posts := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		offsets = append(offsets, r.Header.Get("Stream-Offset"))
+		if posts > 1 {
+			// Skip what was already committed, as busl does.
+			offset, _ := strconv.Atoi(r.Header.Get("Stream-Offset"))
+			io.CopyN(ioutil.Discard, r.Body, int64(len(committed)-offset))
+			b, _ := ioutil.ReadAll(r.Body)
+			committed = append(committed, b...)
+			w.Header().Set("Stream-Committed-Length", strconv.Itoa(len(committed)))
+			return
+		}
+
+		// Take part of the output, then drop the connection.
+		b := make([]byte, 5)
+		io.ReadFull(r.Body, b)
+		committed = append(committed, b...)
+
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	output := newSpool()
+	output.Write([]byte("hello world"))
+	output.Close()
+
+	if err := stream(context.Background(), server.URL, output, &Config{Timeout: 1}); err != nil {
+		t.Fatalf("Expected the upload to resume, got error %v", err)
+	}
+	if posts != 2 {
+		t.Fatalf("Expected 2 POSTs, got %d", posts)
+	}
+	if offsets[0] != "" || offsets[1] != "0" {
+		t.Fatalf("Expected the resumed POST to send its offset, got %q", offsets)
+	}
+	if string(committed) != "hello world" {
+		t.Fatalf("Expected busl to get `hello world`, got %s", committed)
+	}
+	if output.committed() != 11 {
+		t.Fatalf("Expected the spool to drop the committed output, holds from %d", output.committed())
+	}
+}
+
+func TestStreamRetriesExhausted(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	output := newSpool()
+	output.Close()
+
+	err := stream(context.Background(), server.URL, output, &Config{Retry: 1})
+	if !isServerError(err) {
+		t.Fatalf("Expected a server error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", n)
+	}
+}
+
+func TestRunWaitsForUpload(t *testing.T) {
+	post := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		b, _ := ioutil.ReadAll(r.Body)
+		post <- b
+	}))
+	defer server.Close()
+
+	if code := Run(server.URL, []string{"printf", "hello"}, &Config{UploadDeadline: 5}); code != 0 {
+		t.Fatalf("Expected exit code to be 0, got %d", code)
+	}
+
+	select {
+	case result := <-post:
+		if string(result) != "hello" {
+			t.Fatalf("Expected POST body to be `hello`, got %s", result)
+		}
+	default:
+		t.Fatalf("Expected Run to wait for the upload")
+	}
+}
+
+func TestRunUploadDeadline(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+
+	start := time.Now()
+	Run(server.URL, []string{"printf", "hello"}, &Config{UploadDeadline: 0.1})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected to stop waiting by the deadline, took %v", elapsed)
+	}
+}
+
+func TestRunSpool(t *testing.T) {
+	defer func(backoff time.Duration) { spoolBackoff = backoff }(spoolBackoff)
+	spoolBackoff = 10 * time.Millisecond
+	defer func(delay time.Duration) { resumeDelay = delay }(resumeDelay)
+	resumeDelay = 0
+
+	dir, _ := ioutil.TempDir("", "busltee")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "output.log")
+
+	// busl is down until the command exits.
+	var attempts int32
+	post := make(chan []byte, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Stream-Offset") != "0" || atomic.AddInt32(&attempts, 1) < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		post <- b
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conf := &Config{SpoolFile: path, SpoolDeadline: 1}
+	if code := Run(server.URL, []string{"printf", "hello"}, conf); code != 0 {
+		t.Fatalf("Expected exit code to be 0, got %d", code)
+	}
+
+	select {
+	case result := <-post:
+		if string(result) != "hello" {
+			t.Fatalf("Expected POST body to be `hello`, got %s", result)
+		}
+	default:
+		t.Fatalf("Expected the spool file to be uploaded")
+	}
+
+	if b, _ := ioutil.ReadFile(path); string(b) != "hello" {
+		t.Fatalf("Expected spool file to hold `hello`, got %s", b)
+	}
+}
+
+func TestRunSpoolAfterTimeout(t *testing.T) {
+	defer func(interval time.Duration) { commitInterval = interval }(commitInterval)
+	commitInterval = 10 * time.Millisecond
+
+	dir, _ := ioutil.TempDir("", "busltee")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "output.log")
+
+	// busl commits part of the output, then hangs.
+	streamed := make(chan struct{})
+	post := make(chan []byte, 1)
+	var offset string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD":
+			w.Header().Set("Content-Length", "5")
+		case r.Header.Get("Stream-Offset") == "":
+			ioutil.ReadAll(r.Body)
+			<-r.Context().Done()
+			close(streamed)
+		default:
+			// The hanging upload must be stopped first.
+			select {
+			case <-streamed:
+			case <-time.After(time.Second):
+				t.Errorf("Expected the upload to be cancelled before the spool file is sent")
+			}
+			offset = r.Header.Get("Stream-Offset")
+			b, _ := ioutil.ReadAll(r.Body)
+			post <- b
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conf := &Config{SpoolFile: path, SpoolDeadline: 1, UploadDeadline: 0.2}
+	Run(server.URL, []string{"printf", "hello world"}, conf)
+
+	select {
+	case result := <-post:
+		if offset != "5" || string(result) != " world" {
+			t.Fatalf("Expected the spool file to be sent from 5, got %q from %s", result, offset)
+		}
+	default:
+		t.Fatalf("Expected the spool file to be uploaded")
+	}
+}
+
+func TestUploadSpoolDeadline(t *testing.T) {
+	defer func(backoff time.Duration) { spoolBackoff = backoff }(spoolBackoff)
+	spoolBackoff = 10 * time.Millisecond
+
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	file, _ := ioutil.TempFile("", "busltee")
+	defer os.Remove(file.Name())
+	file.Close()
+
+	start := time.Now()
+	err := uploadSpool(server.URL, 0, &Config{SpoolFile: file.Name(), SpoolDeadline: 0.1})
+	if !isServerError(err) {
+		t.Fatalf("Expected a server error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n < 2 {
+		t.Fatalf("Expected the upload to be retried, got %d attempts", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected to give up by the deadline, took %v", elapsed)
+	}
+}
+
+func TestRunFramed(t *testing.T) {
+	server, post := fauxBusl()
+	defer server.Close()
+
+	args := []string{"sh", "-c", "printf out; printf err >&2"}
+	if code := Run(server.URL, args, &Config{Framed: true}); code != 0 {
+		t.Fatalf("Expected exit code to be 0, got %d", code)
+	}
+
+	var result []byte
+	select {
+	case result = <-post:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("POST channel got no response")
+	}
+
+	data := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(result)), "\n") {
+		var f frame
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatalf("Expected a JSON record, got %s", line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, f.Time); err != nil {
+			t.Fatalf("Expected an RFC3339 time, got %s", f.Time)
+		}
+		data[f.Source] += f.Data
+	}
+
+	if data["stdout"] != "out" || data["stderr"] != "err" {
+		t.Fatalf("Expected stdout `out` and stderr `err`, got %v", data)
+	}
+}
+
+func TestFramedOutputSplitRune(t *testing.T) {
+	output := newSpool()
+	stdout, stderr := newFramedOutput(output)
+
+	stdout.Write([]byte("caf\xc3"))
+	stdout.Write([]byte("\xa9"))
+	stdout.Close()
+	stderr.Close()
+
+	b, _ := ioutil.ReadAll(output.NewReader(0))
+
+	var data string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var f frame
+		json.Unmarshal([]byte(line), &f)
+		data += f.Data
+	}
+	if data != "café" {
+		t.Fatalf("Expected `café`, got %q", data)
+	}
+}
+
+func TestRunPrefixed(t *testing.T) {
+	server, post := fauxBusl()
+	defer server.Close()
+
+	conf := &Config{Timestamps: "elapsed", Label: "build"}
+	if code := Run(server.URL, []string{"printf", "one\ntwo"}, conf); code != 0 {
+		t.Fatalf("Expected exit code to be 0, got %d", code)
+	}
+
+	select {
+	case result := <-post:
+		re := regexp.MustCompile(`^00:00:00\.\d{3} \[build\] one\n00:00:00\.\d{3} \[build\] two$`)
+		if !re.Match(result) {
+			t.Fatalf("Expected POST body to be prefixed, got %s", result)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("POST channel got no response")
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	output := newSpool()
+	w := (&prefixer{label: "x"}).NewWriter(output)
+
+	// Partial lines are prefixed once, redrawn ones again.
+	for _, chunk := range []string{"a", "b\nc\r", "\n", "50%\r100%\n"} {
+		w.Write([]byte(chunk))
+	}
+	w.Close()
+
+	b, _ := ioutil.ReadAll(output.NewReader(0))
+	if expected := "[x] ab\n[x] c\r\n[x] 50%\r[x] 100%\n"; string(b) != expected {
+		t.Fatalf("Expected %q, got %q", expected, b)
+	}
+}
+
+func TestFormatElapsed(t *testing.T) {
+	if s := formatElapsed(time.Hour + 2*time.Minute + 3*time.Second + 45*time.Millisecond); s != "01:02:03.045" {
+		t.Fatalf("Expected `01:02:03.045`, got %s", s)
+	}
+}
+
+func Test_runClosesOutput(t *testing.T) {
+	r, w := io.Pipe()
+
+	copied := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		copied <- b
+	}()
+	run([]string{"printf", "hello"}, w, w)
+
+	select {
+	case out := <-copied:
+		if string(out) != "hello" {
+			t.Fatalf("Expected reader to have generated `hello`, got %s", out)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the output to be closed once the command exited")
+	}
+}
+
+func TestSpoolCommit(t *testing.T) {
+	output := newSpool()
+	output.Write([]byte("hello world"))
+	output.Close()
+	output.commit(6)
+
+	if n := len(output.buf); n != 5 {
+		t.Fatalf("Expected the spool to hold 5 bytes, got %d", n)
+	}
+	if b, _ := ioutil.ReadAll(output.NewReader(8)); string(b) != "rld" {
+		t.Fatalf("Expected reader to get `rld`, got %s", b)
+	}
+	if _, err := output.NewReader(2).Read(make([]byte, 1)); err != errSpoolTrimmed {
+		t.Fatalf("Expected reading committed output to fail, got %v", err)
+	}
+
+	// Commits behind or past the output are capped.
+	output.commit(3)
+	output.commit(20)
+	if output.committed() != 11 {
+		t.Fatalf("Expected output to be committed up to 11, got %d", output.committed())
+	}
+}
+
+func TestSpoolAbandon(t *testing.T) {
+	f, err := ioutil.TempFile("", "busltee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	output, err := newFileSpool(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Write([]byte("hello"))
+	output.abandon()
+	output.Write([]byte(" world"))
+	output.Close()
+
+	if n := len(output.buf); n != 0 {
+		t.Fatalf("Expected the spool to drop the output, holds %d bytes", n)
+	}
+	if b, _ := ioutil.ReadFile(f.Name()); string(b) != "hello world" {
+		t.Fatalf("Expected spool file to hold `hello world`, got %s", b)
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	defer func(limit int64) { spoolLimit = limit }(spoolLimit)
+	spoolLimit = 2
+
+	output := newSpool()
+	output.Write([]byte("hello world"))
+	output.Close()
+
+	if b, _ := ioutil.ReadAll(output.NewReader(0)); string(b) != "hello world" {
+		t.Fatalf("Expected reader to get `hello world`, got %s", b)
+	}
+	if n := len(output.buf); n > 4 {
+		t.Fatalf("Expected the spool to keep at most 4 bytes once read, holds %d", n)
+	}
+	if output.holds(0) {
+		t.Fatalf("Expected the uncommitted output past the limit to be dropped")
+	}
+}
+
+func TestRunDropsAbandonedOutput(t *testing.T) {
+	output := newSpool()
+	done := post(context.Background(), "", output, &Config{})
+	if err := <-done; err != errMissingURL {
+		t.Fatalf("Expected errMissingURL, got %v", err)
+	}
+
+	output.Write([]byte("hello"))
+	if n := len(output.buf); n != 0 {
+		t.Fatalf("Expected the output to be discarded once the upload was abandoned, holds %d bytes", n)
+	}
+}
+
+func TestSpoolReader(t *testing.T) {
+	output := newSpool()
+	output.Write([]byte("hello"))
+
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(output.NewReader(2))
+		done <- b
+	}()
+
+	output.Write([]byte(" world"))
+	output.Close()
+
+	if b := <-done; string(b) != "llo world" {
+		t.Fatalf("Expected reader to get `llo world`, got %s", b)
+	}
+	if _, err := output.Write([]byte("!")); err != io.ErrClosedPipe {
+		t.Fatalf("Expected writes after Close to fail, got %v", err)
+	}
+}
+
 func fauxBusl() (*httptest.Server, chan []byte) {
 	post := make(chan []byte, 10)
 
@@ -0,0 +1,205 @@
+package busltee
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Buffers what the command writes until busl committed it,
+// so an upload can be resumed from there once its connection
+// breaks. Writes never block on the upload.
+type spool struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	buf       []byte
+	start     int64    // offset of buf, what's before was dropped
+	acked     int64    // offset up to which busl committed the output
+	limit     int64    // most output kept once it was read
+	file      *os.File // copy of the output kept on disk, if any
+	abandoned bool
+	closed    bool
+}
+
+// Most output kept in memory after it was sent, for an upload
+// to resume from. Past it, busl has to commit the output for a
+// broken upload to be resumed.
+var spoolLimit int64 = 64 << 20
+
+var errSpoolTrimmed = errors.New("Output already dropped from the spool")
+
+func newSpool() *spool {
+	s := &spool{limit: spoolLimit}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// Returns a spool also writing the output to the file at
+// path, so it can be uploaded once the command exits.
+func newFileSpool(path string) (*spool, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSpool()
+	s.file = file
+	return s, nil
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if s.abandoned {
+		s.start += int64(len(p))
+	} else {
+		s.buf = append(s.buf, p...)
+		s.cond.Broadcast()
+	}
+
+	// A failing disk shouldn't fail the command.
+	if s.file != nil {
+		if _, err := s.file.Write(p); err != nil {
+			log.Printf("count#busltee.spool.error=1 error=%v", err.Error())
+			s.file.Close()
+			s.file = nil
+		}
+	}
+
+	return len(p), nil
+}
+
+// Marks the end of the output. Closing it again is a no-op,
+// as stdout and stderr share the spool.
+func (s *spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// Drops the output before offset, which busl committed.
+func (s *spool) commit(offset int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if end := s.start + int64(len(s.buf)); offset > end {
+		offset = end
+	}
+	if offset > s.acked {
+		s.acked = offset
+	}
+	s.drop(offset)
+}
+
+// Drops the output before offset. Must be called with the
+// mutex held.
+func (s *spool) drop(offset int64) {
+	if offset <= s.start {
+		return
+	}
+
+	// Copied, so the memory of the dropped output is freed.
+	s.buf = append([]byte(nil), s.buf[offset-s.start:]...)
+	s.start = offset
+}
+
+// Stops keeping the output in memory, once nothing uploads
+// it anymore. The spool file still gets all of it.
+func (s *spool) abandon() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.start += int64(len(s.buf))
+	s.buf = nil
+	s.abandoned = true
+	s.cond.Broadcast()
+}
+
+// Returns the offset up to which the output is known to be
+// committed, where an upload resumes from.
+func (s *spool) committed() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.acked
+}
+
+// Tells whether the output from offset on is still held.
+func (s *spool) holds(offset int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return offset >= s.start
+}
+
+// Tells whether the whole output made it to the spool file.
+func (s *spool) onDisk() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.file != nil
+}
+
+// Returns a reader of the output starting at offset, which
+// blocks for more until the spool is closed. Reading output
+// dropped once committed fails.
+func (s *spool) NewReader(offset int64) *spoolReader {
+	return &spoolReader{spool: s, offset: offset}
+}
+
+type spoolReader struct {
+	spool  *spool
+	offset int64
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	s := r.spool
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for r.offset >= s.start+int64(len(s.buf)) && !s.closed {
+		s.cond.Wait()
+	}
+
+	if r.offset < s.start {
+		return 0, errSpoolTrimmed
+	}
+	if r.offset >= s.start+int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.buf[r.offset-s.start:])
+	r.offset += int64(n)
+
+	// Dropped in batches rather than on every read, as the rest
+	// of the output gets copied.
+	if r.offset-s.start > 2*s.limit {
+		s.drop(r.offset - s.limit)
+	}
+	return n, nil
+}
+
+// Returns the offset of the next byte to be read. The
+// transport may still be reading after a failed request.
+func (r *spoolReader) Offset() int64 {
+	r.spool.mutex.Lock()
+	defer r.spool.mutex.Unlock()
+
+	return r.offset
+}
@@ -36,6 +36,17 @@ func parseFlags() (*busltee.Config, error) {
 	flag.BoolVarP(&conf.Insecure, "insecure", "k", false, "allows insecure SSL connections")
 	flag.IntVar(&conf.Retry, "retry", 5, "max retries for connect timeout errors")
 	flag.Float64Var(&conf.Timeout, "connect-timeout", 1, "max number of seconds to connect to busl URL")
+	flag.Float64Var(&conf.UploadDeadline, "upload-deadline", 60, "max number of seconds to wait for the upload once the command exits, 0 for no limit")
+
+	// Output related flags
+	flag.BoolVar(&conf.Framed, "framed", false, "streams stdout and stderr as NDJSON records tagged with their source and time")
+	flag.StringVar(&conf.Timestamps, "timestamps", "", "prefixes streamed lines with a timestamp, rfc3339 or elapsed")
+	flag.StringVar(&conf.Label, "label", "", "prefixes streamed lines with a label")
+	flag.BoolVar(&conf.PrefixLocal, "prefix-local", false, "also prefixes lines of the local stdout and stderr")
+
+	// Spooling related flags
+	flag.StringVar(&conf.SpoolFile, "spool-file", "", "file keeping the output, uploaded after the command exits if streaming failed")
+	flag.Float64Var(&conf.SpoolDeadline, "spool-deadline", 300, "max number of seconds to retry uploading the spool file")
 
 	// Logging related flags
 	flag.StringVar(&conf.LogPrefix, "log-prefix", "", "log prefix")
@@ -45,6 +56,12 @@ func parseFlags() (*busltee.Config, error) {
 		return nil, errors.New("insufficient args")
 	}
 
+	switch conf.Timestamps {
+	case "", "rfc3339", "elapsed":
+	default:
+		return nil, errors.New("invalid timestamps")
+	}
+
 	conf.URL = flag.Arg(0)
 	conf.Args = flag.Args()[1:]
 
@@ -0,0 +1,373 @@
+// Package crypt encrypts stream data at rest with AES-GCM.
+//
+// Every stream gets its own random data key, stored alongside
+// the stream wrapped (encrypted) by one of the master keys of
+// `-encryptionKeys`, along with that key's ID. The first master
+// key wraps new data keys; the others are only kept to unwrap
+// the data keys of older streams, which allows rotating keys.
+//
+// Data is sealed in chunks of ChunkSize bytes, each taking
+// SlotSize bytes once sealed, so any byte range can be read
+// by opening only the chunks it spans.
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/heroku/busl/util"
+)
+
+const (
+	ChunkSize = 4 << 10
+	Overhead  = nonceSize + tagSize
+	SlotSize  = ChunkSize + Overhead
+
+	nonceSize = 12
+	tagSize   = 16
+	keySize   = 32
+)
+
+var (
+	ErrUnknownKey = errors.New("crypt: unknown master key")
+	ErrCorrupt    = errors.New("crypt: message authentication failed")
+)
+
+// Reports whether master keys are configured, in which case
+// new streams get encrypted.
+func Enabled() bool {
+	return *util.EncryptionKeys != ""
+}
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Parses `-encryptionKeys`: a comma separated list of
+// `<id>:<base64 key>`, keys being 16, 24 or 32 bytes long.
+func masterKeys() ([]masterKey, error) {
+	var keys []masterKey
+
+	for _, entry := range strings.Split(*util.EncryptionKeys, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		i := strings.Index(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("crypt: invalid key %q, expected <id>:<base64 key>", entry)
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("crypt: invalid key %q: %v", entry[:i], err)
+		}
+
+		aead, err := newAEAD(secret)
+		if err != nil {
+			return nil, fmt.Errorf("crypt: invalid key %q: %v", entry[:i], err)
+		}
+		keys = append(keys, masterKey{entry[:i], aead})
+	}
+	return keys, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// DataKey encrypts the data of a single stream.
+type DataKey struct {
+	envelope string
+	aead     cipher.AEAD
+}
+
+// Generates a data key, wrapped with the current master key.
+func NewDataKey() (*DataKey, error) {
+	keys, err := masterKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrUnknownKey
+	}
+	master := keys[0]
+
+	secret := make([]byte, keySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrapped := master.aead.Seal(nonce, nonce, secret, []byte(master.id))
+
+	return &DataKey{master.id + ":" + base64.StdEncoding.EncodeToString(wrapped), aead}, nil
+}
+
+// Unwraps a data key from its envelope, as returned by
+// Envelope, using the master key it names.
+func OpenDataKey(envelope string) (*DataKey, error) {
+	i := strings.LastIndex(envelope, ":")
+	if i < 0 {
+		return nil, ErrCorrupt
+	}
+	id := envelope[:i]
+
+	wrapped, err := base64.StdEncoding.DecodeString(envelope[i+1:])
+	if err != nil || len(wrapped) < nonceSize {
+		return nil, ErrCorrupt
+	}
+
+	keys, err := masterKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, master := range keys {
+		if master.id != id {
+			continue
+		}
+
+		secret, err := master.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(id))
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		aead, err := newAEAD(secret)
+		if err != nil {
+			return nil, err
+		}
+		return &DataKey{envelope, aead}, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// Returns the wrapped form of the key, safe to store
+// next to the data: `<master key id>:<base64 data>`.
+func (k *DataKey) Envelope() string {
+	return k.envelope
+}
+
+// Returns the ID of the master key wrapping k.
+func (k *DataKey) KeyID() string {
+	return k.envelope[:strings.LastIndex(k.envelope, ":")]
+}
+
+// Seals plain as the chunk at index. The index is
+// authenticated, so chunks can't be swapped around.
+// Each seal uses a fresh nonce, which makes resealing
+// a growing chunk safe.
+func (k *DataKey) Seal(index int64, plain []byte) []byte {
+	return k.seal(chunkIndex(index), plain)
+}
+
+// Opens a chunk sealed with Seal.
+func (k *DataKey) Open(index int64, sealed []byte) ([]byte, error) {
+	return k.open(chunkIndex(index), sealed)
+}
+
+func (k *DataKey) seal(ad, plain []byte) []byte {
+	nonce := make([]byte, nonceSize, nonceSize+len(plain)+tagSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return k.aead.Seal(nonce, nonce, plain, ad)
+}
+
+func (k *DataKey) open(ad, sealed []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, ErrCorrupt
+	}
+
+	plain, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], ad)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plain, nil
+}
+
+func chunkIndex(index int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(index))
+	return b
+}
+
+// Authenticates whether the chunk at index is the last one,
+// for data sealed whole, so it can't be cut short at the end
+// of a chunk.
+func finalChunk(index int64, final bool) []byte {
+	b := append(chunkIndex(index), 0)
+	if final {
+		b[8] = 1
+	}
+	return b
+}
+
+// Splits plain into chunks, the first one being the chunk
+// at index, and seals them one after the other.
+func (k *DataKey) SealChunks(index int64, plain []byte) []byte {
+	var buf bytes.Buffer
+	for ; len(plain) > 0; index++ {
+		n := len(plain)
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+		buf.Write(k.Seal(index, plain[:n]))
+		plain = plain[n:]
+	}
+	return buf.Bytes()
+}
+
+// Opens consecutive chunks sealed with SealChunks, the
+// first one being the chunk at index.
+func (k *DataKey) OpenChunks(index int64, sealed []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	for ; len(sealed) > 0; index++ {
+		n := len(sealed)
+		if n > SlotSize {
+			n = SlotSize
+		}
+
+		plain, err := k.Open(index, sealed[:n])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(plain)
+		sealed = sealed[n:]
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the size of the data held in size bytes of
+// sealed chunks.
+func PlainSize(size int64) int64 {
+	plain := size / SlotSize * ChunkSize
+	if rest := size % SlotSize; rest > Overhead {
+		plain += rest - Overhead
+	}
+	return plain
+}
+
+// Marks the start of data encrypted with Encrypt.
+var magic = []byte("BUSLENC1")
+
+// Encrypts plain under a new data key. The result is self
+// contained: the envelope of the data key is prepended.
+// The last chunk is sealed as such, empty if need be, so
+// a truncated copy fails to open.
+//
+//	magic | envelope length (2 bytes) | envelope | chunks
+func Encrypt(plain []byte) ([]byte, error) {
+	key, err := NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(magic)
+	binary.Write(&buf, binary.BigEndian, uint16(len(key.envelope)))
+	buf.WriteString(key.envelope)
+
+	for index := int64(0); ; index++ {
+		n := len(plain)
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+		final := n == len(plain)
+		buf.Write(key.seal(finalChunk(index, final), plain[:n]))
+		if final {
+			return buf.Bytes(), nil
+		}
+		plain = plain[n:]
+	}
+}
+
+// Returns a reader decrypting data encrypted with Encrypt.
+func NewReader(rd io.Reader) (io.Reader, error) {
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(rd, header); err != nil || !bytes.Equal(header[:len(magic)], magic) {
+		return nil, ErrCorrupt
+	}
+
+	envelope := make([]byte, binary.BigEndian.Uint16(header[len(magic):]))
+	if _, err := io.ReadFull(rd, envelope); err != nil {
+		return nil, ErrCorrupt
+	}
+
+	key, err := OpenDataKey(string(envelope))
+	if err != nil {
+		return nil, err
+	}
+	return &reader{rd: bufio.NewReader(rd), key: key, slot: make([]byte, SlotSize)}, nil
+}
+
+type reader struct {
+	rd      *bufio.Reader
+	key     *DataKey
+	index   int64
+	slot    []byte
+	pending []byte
+	err     error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		var final bool
+		n, err := io.ReadFull(r.rd, r.slot)
+		switch err {
+		case nil:
+			// A full chunk is the last one when nothing follows.
+			_, err = r.rd.Peek(1)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			final = err == io.EOF
+		case io.EOF:
+			// The last chunk, sealed as such, is missing.
+			r.err = ErrCorrupt
+			return 0, r.err
+		case io.ErrUnexpectedEOF:
+			// Only the last chunk may be short.
+			final = true
+		default:
+			return 0, err
+		}
+
+		if r.pending, err = r.key.open(finalChunk(r.index, final), r.slot[:n]); err != nil {
+			r.err = err
+			return 0, err
+		}
+		if final {
+			r.err = io.EOF
+		}
+		r.index++
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
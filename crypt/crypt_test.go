@@ -0,0 +1,140 @@
+package crypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/heroku/busl/util"
+)
+
+const (
+	key1 = "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	key2 = "k2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func withKeys(keys string) func() {
+	*util.EncryptionKeys = keys
+	return func() {
+		*util.EncryptionKeys = ""
+	}
+}
+
+func TestMasterKeys(t *testing.T) {
+	defer withKeys(key1 + ", " + key2)()
+
+	keys, err := masterKeys()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, "k1", keys[0].id)
+	assert.Equal(t, "k2", keys[1].id)
+
+	for _, invalid := range []string{"k1", ":MDEy", "k1:not base64", "k1:MDEyMzQ1Njc="} {
+		*util.EncryptionKeys = invalid
+		_, err := masterKeys()
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDataKeyRotation(t *testing.T) {
+	defer withKeys(key1)()
+
+	key, err := NewDataKey()
+	assert.Nil(t, err)
+	assert.Equal(t, "k1", key.KeyID())
+	sealed := key.Seal(0, []byte("hello"))
+
+	// A new master key comes first, the old one still
+	// unwraps existing data keys.
+	*util.EncryptionKeys = key2 + "," + key1
+	newer, err := NewDataKey()
+	assert.Nil(t, err)
+	assert.Equal(t, "k2", newer.KeyID())
+
+	older, err := OpenDataKey(key.Envelope())
+	assert.Nil(t, err)
+	plain, err := older.Open(0, sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(plain))
+
+	// Once retired, it can't.
+	*util.EncryptionKeys = key2
+	_, err = OpenDataKey(key.Envelope())
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+func TestSealChunks(t *testing.T) {
+	defer withKeys(key1)()
+
+	key, _ := NewDataKey()
+	plain := bytes.Repeat([]byte("0123456789"), ChunkSize/4)
+
+	sealed := key.SealChunks(0, plain)
+	assert.Equal(t, int64(len(plain)), PlainSize(int64(len(sealed))))
+
+	opened, err := key.OpenChunks(0, sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, opened)
+
+	// Any chunk can be opened on its own.
+	opened, err = key.OpenChunks(2, sealed[2*SlotSize:])
+	assert.Nil(t, err)
+	assert.Equal(t, plain[2*ChunkSize:], opened)
+
+	// Chunks are bound to their index.
+	_, err = key.OpenChunks(1, sealed[2*SlotSize:])
+	assert.Equal(t, ErrCorrupt, err)
+
+	sealed[SlotSize+nonceSize] ^= 1
+	_, err = key.OpenChunks(0, sealed)
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestPlainSize(t *testing.T) {
+	assert.Equal(t, int64(0), PlainSize(0))
+	assert.Equal(t, int64(0), PlainSize(Overhead))
+	assert.Equal(t, int64(1), PlainSize(Overhead+1))
+	assert.Equal(t, int64(ChunkSize), PlainSize(SlotSize))
+	assert.Equal(t, int64(ChunkSize+5), PlainSize(SlotSize+Overhead+5))
+}
+
+func TestEncryptReader(t *testing.T) {
+	defer withKeys(key1)()
+
+	for _, plain := range []string{"", "hello", strings.Repeat("busl", ChunkSize)} {
+		sealed, err := Encrypt([]byte(plain))
+		assert.Nil(t, err)
+
+		rd, err := NewReader(bytes.NewReader(sealed))
+		assert.Nil(t, err)
+		opened, err := ioutil.ReadAll(rd)
+		assert.Nil(t, err)
+		assert.Equal(t, plain, string(opened))
+	}
+
+	_, err := NewReader(strings.NewReader("hello world"))
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestEncryptTruncated(t *testing.T) {
+	defer withKeys(key1)()
+
+	plain := strings.Repeat("busl", ChunkSize)
+	sealed, err := Encrypt([]byte(plain))
+	assert.Nil(t, err)
+	header := len(sealed) - 4*SlotSize
+
+	// Cut at the end of a chunk, or after the data.
+	for _, corrupt := range [][]byte{
+		sealed[:header+2*SlotSize],
+		sealed[:header],
+		append(append([]byte(nil), sealed...), sealed[header:header+SlotSize]...),
+	} {
+		rd, err := NewReader(bytes.NewReader(corrupt))
+		assert.Nil(t, err)
+		_, err = ioutil.ReadAll(rd)
+		assert.Equal(t, ErrCorrupt, err)
+	}
+}
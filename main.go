@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	"github.com/heroku/busl/server"
+	"github.com/heroku/busl/storage"
 	"github.com/heroku/busl/util"
 )
 
@@ -21,5 +22,9 @@ func main() {
 		log.Printf("%s: $PORT must be an integer value.\n", os.Args[0])
 		os.Exit(1)
 	}
+	if *util.S3PartSize < storage.MinS3PartSize {
+		log.Printf("%s: -s3PartSize must be at least %d bytes.\n", os.Args[0], storage.MinS3PartSize)
+		os.Exit(1)
+	}
 	server.Start(*util.HttpPort, util.AwaitSignals(syscall.SIGURG))
 }
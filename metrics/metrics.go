@@ -0,0 +1,218 @@
+// Package metrics keeps an in-process registry of counters,
+// gauges and histograms, exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Default buckets, suited to latencies in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+type entry struct {
+	help   string
+	kind   string
+	metric metric
+}
+
+var (
+	mutex    sync.Mutex
+	registry = map[string]*entry{}
+)
+
+// Returns the metric registered under name, registering
+// the one built by fn if there's none yet.
+func register(name, help, kind string, fn func() metric) metric {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if e, ok := registry[name]; ok && e.kind == kind {
+		return e.metric
+	}
+
+	m := fn()
+	registry[name] = &entry{help, kind, m}
+	return m
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value int64
+}
+
+// Registers a counter, or returns the existing one with that name.
+func NewCounter(name, help string) *Counter {
+	return register(name, help, "counter", func() metric { return &Counter{} }).(*Counter)
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(n int64) { atomic.AddInt64(&c.value, n) }
+
+func (c *Counter) Value() int64 { return atomic.LoadInt64(&c.value) }
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	value int64
+}
+
+// Registers a gauge, or returns the existing one with that name.
+func NewGauge(name, help string) *Gauge {
+	return register(name, help, "gauge", func() metric { return &Gauge{} }).(*Gauge)
+}
+
+func (g *Gauge) Set(n int64) { atomic.StoreInt64(&g.value, n) }
+
+func (g *Gauge) Inc() { g.Add(1) }
+
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) Add(n int64) { atomic.AddInt64(&g.value, n) }
+
+func (g *Gauge) Value() int64 { return atomic.LoadInt64(&g.value) }
+
+func (g *Gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, g.Value())
+}
+
+type gaugeFunc func() float64
+
+func (fn gaugeFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(fn()))
+}
+
+// Registers a gauge whose value is computed by fn on every
+// scrape, replacing any previous one with that name.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	registry[name] = &entry{help, "gauge", gaugeFunc(fn)}
+}
+
+// Histogram samples observations into cumulative buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64 // upper bounds, sorted
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Registers a histogram, or returns the existing one with that name.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return register(name, help, "histogram", func() metric {
+		b := append([]float64(nil), buckets...)
+		sort.Float64s(b)
+		return &Histogram{buckets: b, counts: make([]uint64, len(b))}
+	}).(*Histogram)
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// Returns n buckets, starting at start and
+// multiplying by factor each time.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Writes all the registered metrics, sorted by name.
+func WriteTo(w io.Writer) {
+	mutex.Lock()
+	names := make([]string, 0, len(registry))
+	entries := make(map[string]*entry, len(registry))
+	for name, e := range registry {
+		names = append(names, name)
+		entries[name] = e
+	}
+	mutex.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		e := entries[name]
+		if e.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, e.help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, e.kind)
+		e.metric.write(w, name)
+	}
+}
+
+// Handler serves the registry in the Prometheus text format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteTo(w)
+}
+
+// Turns an arbitrary name (e.g. `server.sub.keepAlive`)
+// into a valid metric name.
+func Sanitize(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || c == ':' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			'0' <= c && c <= '9'
+		if !valid {
+			b[i] = '_'
+		}
+	}
+
+	// Names can't start with a digit.
+	if len(b) > 0 && '0' <= b[0] && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter.")
+	c.Inc()
+	c.Add(2)
+
+	assert.Equal(t, c, NewCounter("test_counter_total", ""))
+	assert.Equal(t, int64(3), c.Value())
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "A gauge.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	assert.Equal(t, int64(1), g.Value())
+
+	g.Set(10)
+	assert.Equal(t, int64(10), g.Value())
+}
+
+func TestWriteTo(t *testing.T) {
+	NewCounter("test_write_total", "Writes.").Add(5)
+	NewGaugeFunc("test_write_func", "", func() float64 { return 1.5 })
+
+	h := NewHistogram("test_write_seconds", "Durations.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	WriteTo(&buf)
+	out := buf.String()
+
+	assert.Contains(t, out, "# HELP test_write_total Writes.\n# TYPE test_write_total counter\ntest_write_total 5\n")
+	assert.Contains(t, out, "# TYPE test_write_func gauge\ntest_write_func 1.5\n")
+	assert.Contains(t, out, `# TYPE test_write_seconds histogram
+test_write_seconds_bucket{le="0.1"} 2
+test_write_seconds_bucket{le="1"} 3
+test_write_seconds_bucket{le="+Inf"} 4
+test_write_seconds_sum 3.65
+test_write_seconds_count 4
+`)
+}
+
+func TestSanitize(t *testing.T) {
+	assert.Equal(t, "server_sub_keepAlive", Sanitize("server.sub.keepAlive"))
+	assert.Equal(t, "_2xx", Sanitize("2xx"))
+	assert.Equal(t, "http_status_2xx", Sanitize("http.status.2xx"))
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	assert.Equal(t, []float64{1, 2, 4, 8}, ExponentialBuckets(1, 2, 4))
+}
@@ -0,0 +1,235 @@
+// Package redact masks secrets out of published stream data,
+// before it reaches the broker, storage or any subscriber.
+//
+// Secrets are either literals (`-redactSecrets`) or regular
+// expressions (`-redactPatterns`). Every matching byte is
+// replaced by a `*`, which keeps offsets of the stream in line
+// with what the publisher wrote.
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+const mask = '*'
+
+// Redactor masks a set of secrets.
+type Redactor struct {
+	secrets  [][]byte
+	patterns []*regexp.Regexp
+	window   int
+	flush    time.Duration // 0 holds incomplete lines until Close
+}
+
+// Creates a redactor for literal secrets and regular expression
+// patterns. When a pattern has groups, only the first one is
+// masked, e.g. `(?i)bearer\s+(\S+)` keeps the `Bearer` prefix.
+// Incomplete lines are held back up to window bytes, so a
+// secret split across writes is still masked.
+func New(secrets, patterns []string, window int) (*Redactor, error) {
+	r := &Redactor{window: window}
+
+	for _, secret := range secrets {
+		if secret != "" {
+			r.secrets = append(r.secrets, []byte(secret))
+		}
+	}
+
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redact: invalid pattern %q: %v", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Returns the redactor for `-redactSecrets` and `-redactPatterns`,
+// both newline separated, nil when neither is set.
+func Configured() (*Redactor, error) {
+	if *util.RedactSecrets == "" && *util.RedactPatterns == "" {
+		return nil, nil
+	}
+	r, err := New(splitLines(*util.RedactSecrets), splitLines(*util.RedactPatterns), *util.RedactWindow)
+	if err != nil {
+		return nil, err
+	}
+	r.flush = *util.RedactFlush
+	return r, nil
+}
+
+func splitLines(s string) []string {
+	return strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+}
+
+// Masks every secret in p, in place. Returns the number
+// of matches.
+func (r *Redactor) Redact(p []byte) int {
+	matches := 0
+
+	for _, secret := range r.secrets {
+		for i := 0; ; {
+			j := bytes.Index(p[i:], secret)
+			if j < 0 {
+				break
+			}
+			fill(p[i+j : i+j+len(secret)])
+			i += j + len(secret)
+			matches++
+		}
+	}
+
+	for _, re := range r.patterns {
+		for _, loc := range re.FindAllSubmatchIndex(p, -1) {
+			if len(loc) > 2 && loc[2] >= 0 {
+				loc = loc[2:]
+			}
+			fill(p[loc[0]:loc[1]])
+			matches++
+		}
+	}
+	return matches
+}
+
+func fill(p []byte) {
+	for i := range p {
+		p[i] = mask
+	}
+}
+
+// Returns how much of buf can be written out, the rest
+// possibly being the start of a secret: the trailing
+// incomplete line, up to window bytes, or the start of a
+// literal secret. Lines end with \n, or \r for redrawn ones
+// such as progress bars.
+func (r *Redactor) safe(buf []byte) int {
+	n := bytes.LastIndexAny(buf, "\r\n") + 1
+	if len(buf)-n > r.window {
+		n = len(buf) - r.window
+	}
+
+	if k := r.partial(buf); len(buf)-k < n {
+		n = len(buf) - k
+	}
+	return n
+}
+
+// Returns the length of the longest start of a literal
+// secret buf ends with.
+func (r *Redactor) partial(buf []byte) int {
+	n := 0
+	for _, secret := range r.secrets {
+		for k := len(secret) - 1; k > n; k-- {
+			if k <= len(buf) && bytes.HasSuffix(buf, secret[:k]) {
+				n = k
+				break
+			}
+		}
+	}
+	return n
+}
+
+type writer struct {
+	r     *Redactor
+	w     io.WriteCloser
+	mutex sync.Mutex
+	buf   []byte
+	timer *time.Timer // pending flush of buf
+	err   error       // of the last flush
+}
+
+// Wraps w so the secrets of r get masked out of what's
+// written to it. Data held back is written once the flush
+// delay of r passes, or on Close.
+func (r *Redactor) NewWriter(w io.WriteCloser) io.WriteCloser {
+	return &writer{r: r, w: w}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf = append(w.buf, p...)
+	w.redact()
+
+	if n := w.r.safe(w.buf); n > 0 {
+		if _, err := w.w.Write(w.buf[:n]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[n:]...)
+	}
+
+	if len(w.buf) > 0 && w.timer == nil && w.r.flush > 0 {
+		w.timer = time.AfterFunc(w.r.flush, w.flush)
+	}
+	return len(p), nil
+}
+
+// Writes out the data held back for too long, e.g. a
+// prompt waiting for input. The start of a literal secret
+// is still kept until the next write or Close.
+func (w *writer) flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.timer == nil {
+		return
+	}
+	w.timer = nil
+
+	n := len(w.buf) - w.r.partial(w.buf)
+	if n > 0 && w.err == nil {
+		util.Count("redact.flush")
+		_, w.err = w.w.Write(w.buf[:n])
+		w.buf = append(w.buf[:0], w.buf[n:]...)
+	}
+}
+
+func (w *writer) redact() {
+	if matches := w.r.Redact(w.buf); matches > 0 {
+		util.CountMany("redact.matches", int64(matches))
+	}
+}
+
+func (w *writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+
+	if w.err != nil {
+		w.w.Close()
+		return w.err
+	}
+
+	if len(w.buf) > 0 {
+		w.redact()
+		_, err := w.w.Write(w.buf)
+		w.buf = nil
+		if err != nil {
+			w.w.Close()
+			return err
+		}
+	}
+	return w.w.Close()
+}
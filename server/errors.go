@@ -10,7 +10,15 @@ import (
 	"github.com/heroku/busl/util"
 )
 
-var errNoContent = errors.New("No Content")
+var (
+	errNoContent  = errors.New("No Content")
+	errInvalidTTL = errors.New("Invalid stream TTL.")
+
+	errInvalidContentType = errors.New("Unsupported stream content type.")
+
+	errInvalidOffset = errors.New("Invalid stream offset.")
+	errOffsetAhead   = errors.New("Stream offset is past the end of the stream.")
+)
 
 func handleError(w http.ResponseWriter, r *http.Request, err error) {
 	switch err {
@@ -22,7 +30,26 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 
 		http.Error(w, message, http.StatusNotFound)
 
-	case storage.ErrRange:
+	case broker.ErrStreamFull:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+
+	case errInvalidToken:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+	case errForbidden:
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+	case errInvalidTTL, errInvalidOffset:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+	case errInvalidContentType:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+
+	case errOffsetAhead:
+		http.Error(w, err.Error(), http.StatusConflict)
+
+	case storage.ErrRange, errRangeNotSatisfiable:
 		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 
 	case errNoContent:
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/sse"
+	"github.com/heroku/busl/util"
+)
+
+// Wraps readers opened on the storage backend, as
+// opposed to the broker.
+type storageReader struct {
+	io.ReadCloser
+}
+
+// Returns the events sent around the data of an event stream
+// read from rd: the `-sseRetry` hint, an `end` event carrying
+// the final offset once the stream is done and, with
+// `?meta=true`, events about the stream itself: its `source`
+// (broker or storage) on connect, and whether it got
+// `truncated` before it ends.
+func eventOptions(r *http.Request, rd io.Reader) sse.Options {
+	channel := key(r)
+	_, fromStorage := rd.(*storageReader)
+	meta, _ := strconv.ParseBool(r.URL.Query().Get("meta"))
+
+	opts := sse.Options{Retry: *util.SSERetry}
+
+	if meta {
+		source := "broker"
+		if fromStorage {
+			source = "storage"
+		}
+		opts.Head = []sse.Event{{Type: "source", Data: []byte(source)}}
+	}
+
+	opts.Tail = func(offset int64) []sse.Event {
+		// Persisted streams are final.
+		if !fromStorage && !broker.ReaderDone(rd) {
+			return nil
+		}
+
+		var events []sse.Event
+		if meta && !fromStorage {
+			if st, err := broker.GetStatus(channel); err == nil && st.Truncated {
+				events = append(events, sse.Event{Type: "truncated", Data: []byte(strconv.FormatInt(st.Size, 10))})
+			}
+		}
+
+		util.Count("server.sub.sse.end")
+		return append(events, sse.Event{Type: "end", Data: []byte(strconv.FormatInt(offset, 10))})
+	}
+	return opts
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/heroku/busl/util"
+)
+
+// Wraps a response in a gzip stream. Flushing pushes out what
+// was compressed so far before flushing the response itself,
+// so subscribers still get every chunk as it's read.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+// Negotiates a gzip encoded response, returning w as is
+// when the client doesn't accept one. Close the returned
+// writer once done to terminate the gzip stream.
+func newGzipResponseWriter(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() error { return nil }
+	}
+
+	util.Count("server.sub.gzip")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+
+	gz := gzip.NewWriter(w)
+	return &gzipResponseWriter{w, gz}, gz.Close
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *gzipResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// Reports whether the `Accept-Encoding` header lists gzip (or
+// `*`) with a non-zero quality. An explicit gzip entry takes
+// precedence over `*`.
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+
+		q := 1.0
+		for _, param := range params[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
@@ -21,6 +21,7 @@ type keepAliveReader struct {
 	ch       chan *payload // where all the original reads go to
 	done     <-chan bool   // closeNotifier
 	eof      bool          // marked true when we hit EOF
+	pending  *payload      // what's left of a payload p couldn't hold
 }
 
 func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done <-chan bool) io.ReadCloser {
@@ -42,6 +43,10 @@ func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done
 }
 
 func (r *keepAliveReader) Read(p []byte) (int, error) {
+	if r.pending != nil {
+		return r.drain(r.pending, p)
+	}
+
 	if r.eof {
 		return 0, io.EOF
 	}
@@ -51,15 +56,7 @@ func (r *keepAliveReader) Read(p []byte) (int, error) {
 
 	select {
 	case payload := <-r.ch:
-		if payload.n > 0 {
-			copy(p, payload.p[0:payload.n])
-		}
-
-		if payload.err == io.EOF {
-			r.eof = true
-		}
-
-		return payload.n, payload.err
+		return r.drain(payload, p)
 
 	case <-timer.C:
 		util.Count("server.sub.keepAlive")
@@ -73,6 +70,24 @@ func (r *keepAliveReader) Read(p []byte) (int, error) {
 	}
 }
 
+// Copies as much of payload as p can hold. The rest, and the
+// payload error, are held back for the next read.
+func (r *keepAliveReader) drain(payload *payload, p []byte) (int, error) {
+	n := copy(p, payload.p[:payload.n])
+
+	if n < payload.n {
+		payload.p, payload.n = payload.p[n:payload.n], payload.n-n
+		r.pending = payload
+		return n, nil
+	}
+	r.pending = nil
+
+	if payload.err == io.EOF {
+		r.eof = true
+	}
+	return n, payload.err
+}
+
 func (r *keepAliveReader) Close() error {
 	if closer, ok := r.r.(io.Closer); ok {
 		return closer.Close()
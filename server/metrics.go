@@ -0,0 +1,34 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/heroku/busl/metrics"
+)
+
+var (
+	activePublishers  = metrics.NewGauge("busl_publishers_active", "Number of connected publishers.")
+	activeSubscribers = metrics.NewGauge("busl_subscribers_active", "Number of connected subscribers.")
+
+	writeSize = metrics.NewHistogram("busl_write_size_bytes",
+		"Size of the writes published to the broker.",
+		metrics.ExponentialBuckets(64, 4, 8))
+	publishLatency = metrics.NewHistogram("busl_publish_duration_seconds",
+		"Time taken to write published data to the broker.",
+		metrics.DefBuckets)
+)
+
+// Records the size and latency of every write to the broker.
+type instrumentedWriter struct {
+	io.WriteCloser
+}
+
+func (w *instrumentedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.WriteCloser.Write(p)
+
+	writeSize.Observe(float64(len(p)))
+	publishLatency.Observe(time.Since(start).Seconds())
+	return n, err
+}
@@ -1,13 +1,14 @@
 package server
 
 import (
-	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/gorilla/mux"
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/heroku/authenticater"
@@ -49,6 +50,37 @@ func auth(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// Requires a stream token granting perm, once a
+// token secret is configured.
+func authorize(perm string, fn http.HandlerFunc) http.HandlerFunc {
+	return authorizeAny([]string{perm}, fn)
+}
+
+// Requires a stream token granting any of perms, e.g. so
+// publishers can look up how much of their stream got in.
+func authorizeAny(perms []string, fn http.HandlerFunc) http.HandlerFunc {
+	if !tokensEnabled() {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		for _, perm := range perms {
+			if err = verifyToken(key(r), perm, requestToken(r)); err != errForbidden {
+				break
+			}
+		}
+
+		if err != nil {
+			util.CountWithData("server.authorize.fail", 1, "perm=%s error=%q", strings.Join(perms, ","), err.Error())
+			handleError(w, r, err)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
 func logRequest(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := util.NewResponseLogger(w, requestId(r))
@@ -62,8 +94,8 @@ func addDefaultHeaders(fn http.HandlerFunc) http.HandlerFunc {
 		if origin := r.Header.Get("Origin"); origin != "" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Stream-TTL, Stream-Content-Type, Stream-Offset, Delete-Storage")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		fn(w, r)
 	}
@@ -91,7 +123,16 @@ func offset(r *http.Request) int64 {
 	var off string
 
 	if off = r.Header.Get("last-event-id"); off == "" {
-		if val := r.Header.Get("Range"); val != "" {
+		val := r.Header.Get("Range")
+		if rng := parseRange(val); rng != nil {
+			if rng.suffix {
+				return 0
+			}
+			return rng.first
+		}
+
+		// Legacy `Range: <offset>-` form, without a unit.
+		if val != "" {
 			tuple := strings.SplitN(val, "-", 2)
 			off = tuple[0]
 		}
@@ -101,18 +142,73 @@ func offset(r *http.Request) int64 {
 	return int64(n)
 }
 
+// Returns the TTL requested through the `Stream-TTL` header
+// or `ttl` query parameter, given either in seconds or as a
+// duration (e.g. `1h30m`). Falls back to the default stream
+// TTL, and is capped at the maximum stream TTL.
+func streamTTL(r *http.Request) (time.Duration, error) {
+	val := r.Header.Get("Stream-TTL")
+	if val == "" {
+		val = r.URL.Query().Get("ttl")
+	}
+
+	if val == "" {
+		return *util.DefaultStreamTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(val)
+	if err != nil {
+		secs, err := strconv.Atoi(val)
+		if err != nil {
+			return 0, errInvalidTTL
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+
+	if ttl <= 0 {
+		return 0, errInvalidTTL
+	}
+
+	if ttl > *util.MaxStreamTTL {
+		ttl = *util.MaxStreamTTL
+	}
+	return ttl, nil
+}
+
 // Given URL:
 //   http://build-output.heroku.com/streams/1/2/3?foo=bar
 //
 // Returns:
 //   1/2/3?foo=bar
+//
+// The `token` parameter is busl's own and is left out.
 func requestURI(r *http.Request) string {
-	res := key(r)
+	return requestURIWithout(r, "token")
+}
 
-	if r.URL.RawQuery != "" {
-		res += "?" + r.URL.RawQuery
+// Like requestURI, without the given query parameters. The
+// query is left untouched unless one of them is present, so
+// pre-signed storage URLs stay intact.
+func requestURIWithout(r *http.Request, params ...string) string {
+	res := key(r)
+	query := r.URL.RawQuery
+
+	if query != "" {
+		values, found := r.URL.Query(), false
+		for _, param := range params {
+			if _, ok := values[param]; ok {
+				values.Del(param)
+				found = true
+			}
+		}
+		if found {
+			query = values.Encode()
+		}
 	}
 
+	if query != "" {
+		res += "?" + query
+	}
 	return res
 }
 
@@ -120,16 +216,31 @@ func key(r *http.Request) string {
 	return mux.Vars(r)["key"]
 }
 
+// Returns the channel of r and its storage URI, as built by
+// uri. Handlers still working with them once the request
+// completes (e.g. persisting the stream) must capture them
+// up front, as the mux vars are cleared by then.
+func captureVars(r *http.Request, uri func(*http.Request) string) (channel, requestURI string) {
+	return key(r), uri(r)
+}
+
 // Returns a broker or blob reader.
 func newStorageReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
 	// Get the offset from Last-Event-ID: or Range:
-	offset := offset(r)
+	return openReader(key(r), requestURI(r), offset(r))
+}
 
-	rd, err := broker.NewReader(key(r))
+// Returns a broker or blob reader for channel, positioned at offset.
+func openReader(channel, requestURI string, offset int64) (io.ReadCloser, error) {
+	rd, err := broker.NewReader(channel)
 
 	// Not cached in the broker anymore, try the storage backend as a fallback.
 	if err == broker.ErrNotRegistered {
-		return storage.Get(requestURI(r), offset)
+		rd, err := storage.Get(requestURI, offset)
+		if err != nil {
+			return rd, err
+		}
+		return &storageReader{rd}, nil
 	}
 
 	if offset > 0 {
@@ -141,6 +252,14 @@ func newStorageReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, er
 }
 
 func newReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	eventStream := r.Header.Get("Accept") == "text/event-stream"
+
+	// Byte ranges only apply to raw reads. SSE clients resume
+	// through Last-Event-ID, which also takes precedence.
+	if rng := parseRange(r.Header.Get("Range")); rng != nil && !eventStream && r.Header.Get("Last-Event-ID") == "" {
+		return newRangeReader(w, r, rng)
+	}
+
 	rd, err := newStorageReader(w, r)
 	if err != nil {
 		if rd != nil {
@@ -157,26 +276,126 @@ func newReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
 		return nil, errNoContent
 	}
 
-	if r.Header.Get("Accept") == "text/event-stream" {
+	records := channelContentType(r) == contentTypeNDJSON
+
+	if eventStream {
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 
-		encoder := sse.NewEncoder(rd)
-		encoder.(io.Seeker).Seek(offset(r), 0)
+		opts := eventOptions(r, rd)
+		if records {
+			// One event per record, optionally filtered.
+			opts.RecordType = recordEventType(r)
+			encoder := sse.NewRecordEncoder(rd, recordFilter(r), opts)
+			encoder.(io.Seeker).Seek(offset(r), 0)
+
+			rd = &limitedReadCloser{encoder, rd}
+		} else {
+			encoder := sse.NewEncoderWithOptions(rd, opts)
+			encoder.(io.Seeker).Seek(offset(r), 0)
 
-		rd = ioutil.NopCloser(encoder)
+			rd = ioutil.NopCloser(encoder)
+		}
 
 		// For SSE, we change the ack to a :keepalive
 		ack = []byte(":keepalive\n")
+	} else if records {
+		w.Header().Set("Content-Type", contentTypeNDJSON)
+
+		if keep := recordFilter(r); keep != nil {
+			rd = &limitedReadCloser{newRecordFilterReader(rd, keep), rd}
+		}
+
+		// A null byte would corrupt the records, while
+		// blank lines are commonly skipped.
+		ack = []byte("\n")
 	}
 
 	done := w.(http.CloseNotifier).CloseNotify()
 	return newKeepAliveReader(rd, ack, *util.HeartbeatDuration, done), nil
 }
 
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Serves a single byte range with a `206 Partial Content`.
+func newRangeReader(w http.ResponseWriter, r *http.Request, rng *byteRange) (io.ReadCloser, error) {
+	st, err := lookupStatus(r)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last, err := rng.resolve(st.Size, st.Done)
+	if err == errRangeNotSatisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", st.Size))
+		return nil, err
+	}
+
+	rd, err := openReader(key(r), requestURI(r), first)
+	if err != nil {
+		if rd != nil {
+			rd.Close()
+		}
+		return nil, err
+	}
+
+	// A keepalive ack would corrupt the requested bytes, so
+	// idle periods only renew the stream expiry.
+	done := w.(http.CloseNotifier).CloseNotify()
+	rd = newKeepAliveReader(rd, nil, *util.HeartbeatDuration, done)
+
+	if last >= 0 {
+		length := last - first + 1
+		rd = &limitedReadCloser{io.LimitReader(rd, length), rd}
+
+		// Live streams may end short of the range.
+		if st.Done {
+			w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		}
+	}
+
+	w.Header().Set("Content-Range", contentRange(first, last, st.Size, st.Done))
+	w.WriteHeader(http.StatusPartialContent)
+	return rd, nil
+}
+
+// Uploads the output every `StorageInterval` until done is closed.
+func storePeriodically(channel, requestURI string, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(*util.StorageInterval):
+			// Asynchronously upload the output to our defined storage backend.
+			go storeOutput(channel, requestURI)
+		}
+	}
+}
+
+// Uploads the rest of the output once publishing ended. Called
+// from the publish handler itself, so a graceful shutdown waits
+// for the last segment to be stored.
+func storeFinal(channel, requestURI string) {
+	storeOutput(channel, requestURI)
+	forgetPersister(channel)
+}
+
+// Uploads what was published since the last upload. Uploads of
+// the same stream are serialized, so they can't land out of order.
 func storeOutput(channel string, requestURI string) {
+	p := persisterFor(channel)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	if buf, err := broker.Get(channel); err == nil {
-		if err := storage.Put(requestURI, bytes.NewBuffer(buf)); err != nil {
+		var contentType string
+		if st, err := broker.GetStatus(channel); err == nil {
+			contentType = st.ContentType
+		}
+
+		if err := p.store(requestURI, buf, contentType); err != nil {
 			util.CountWithData("server.storeOutput.put.error", 1, "err=%s", err.Error())
 		}
 	} else {
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+// Returns the offset a publish starts at, as given by the
+// `Stream-Offset` header, or -1 to append wherever the
+// stream ends.
+func requestedOffset(r *http.Request) (int64, error) {
+	val := r.Header.Get("Stream-Offset")
+	if val == "" {
+		return -1, nil
+	}
+
+	offset, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errInvalidOffset
+	}
+	return offset, nil
+}
+
+// Skips the start of body the channel already holds, when
+// the publisher resends from offset. Publishing past the end
+// of the stream would leave a gap, so it's refused.
+func skipCommitted(body io.Reader, channel string, offset int64) error {
+	st, err := broker.GetStatus(channel)
+	if err != nil {
+		return err
+	}
+
+	if offset > st.Size {
+		return errOffsetAhead
+	}
+
+	if skip := st.Size - offset; skip > 0 {
+		n, err := io.CopyN(ioutil.Discard, body, skip)
+		util.CountMany("server.pub.offset.skipped", n)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tells the publisher how much of the stream is committed,
+// which is where it should resume.
+func setCommittedLength(w http.ResponseWriter, channel string) {
+	if st, err := broker.GetStatus(channel); err == nil {
+		w.Header().Set("Stream-Committed-Length", strconv.FormatInt(st.Size, 10))
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/heroku/busl/storage"
+)
+
+// Tracks how much of a stream made it to storage, so
+// uploads only send what was published since.
+type persister struct {
+	mutex  sync.Mutex // serializes the uploads of a stream
+	offset int64      // bytes already in storage
+	stored bool       // whether anything was uploaded yet
+	synced bool       // whether offset was looked up in storage
+}
+
+var persisters = struct {
+	sync.Mutex
+	m map[string]*persister
+}{m: map[string]*persister{}}
+
+func persisterFor(channel string) *persister {
+	persisters.Lock()
+	defer persisters.Unlock()
+
+	p, ok := persisters.m[channel]
+	if !ok {
+		p = &persister{}
+		persisters.m[channel] = p
+	}
+	return p
+}
+
+// Drops the state of a stream once its publisher is done.
+// Should it get published to again, the offset is looked
+// up in storage instead.
+func forgetPersister(channel string) {
+	persisters.Lock()
+	defer persisters.Unlock()
+
+	delete(persisters.m, channel)
+}
+
+// Uploads whatever buf holds past the stored offset as a new
+// segment, along with the content type of the stream. Backends
+// bound to pre-signed URLs can't hold more than one object, so
+// the whole buffer is uploaded there, but only when it changed.
+func (p *persister) store(requestURI string, buf []byte, contentType string) error {
+	size := int64(len(buf))
+
+	if !storage.Segmented() {
+		if p.stored && size == p.offset {
+			return nil
+		}
+		if err := storage.PutWithContentType(requestURI, bytes.NewReader(buf), contentType); err != nil {
+			return err
+		}
+		p.offset, p.stored = size, true
+		return nil
+	}
+
+	if !p.synced {
+		if err := p.sync(requestURI, size); err != nil {
+			return err
+		}
+	}
+
+	if p.stored && size == p.offset {
+		return nil
+	}
+
+	if err := storage.PutSegmentWithContentType(requestURI, p.offset, bytes.NewReader(buf[p.offset:]), contentType); err != nil {
+		return err
+	}
+	p.offset, p.stored = size, true
+	return nil
+}
+
+// Picks up where a previous publisher left off. A stored
+// stream larger than what the broker holds was reset since,
+// and is uploaded again from the start.
+func (p *persister) sync(requestURI string, size int64) error {
+	stored, err := storage.Size(requestURI)
+	switch err {
+	case nil:
+		p.stored = true
+	case storage.ErrNotFound:
+	default:
+		return err
+	}
+
+	if stored > size {
+		if err := storage.Delete(requestURI); err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		stored, p.stored = 0, false
+	}
+
+	p.offset, p.synced = stored, true
+	return nil
+}
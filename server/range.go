@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errRangeNotSatisfiable = errors.New("Range Not Satisfiable")
+
+// A single `Range: bytes=...` spec. last is -1 for open
+// ended ranges. For suffix ranges (`bytes=-500`), last
+// holds the number of trailing bytes requested.
+type byteRange struct {
+	first  int64
+	last   int64
+	suffix bool
+}
+
+// Parses a Range header as per RFC 7233. Returns nil for
+// anything we can't serve as a single range, in which case
+// the header is ignored, as the RFC allows.
+func parseRange(val string) *byteRange {
+	if len(val) < 6 || !strings.EqualFold(val[:6], "bytes=") {
+		return nil
+	}
+
+	spec := strings.TrimSpace(val[6:])
+	if strings.Contains(spec, ",") {
+		// Multipart responses aren't supported.
+		return nil
+	}
+
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return nil
+	}
+	start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if start == "" {
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n <= 0 {
+			return nil
+		}
+		return &byteRange{last: n, suffix: true}
+	}
+
+	first, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || first < 0 {
+		return nil
+	}
+
+	if end == "" {
+		return &byteRange{first: first, last: -1}
+	}
+
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || last < first {
+		return nil
+	}
+	return &byteRange{first: first, last: last}
+}
+
+// Resolves the range against the current size of a stream.
+// Once a stream is done its size is final and the range is
+// clamped to it. For live streams, bytes past the current
+// size are still to come, so only suffix ranges need the size.
+func (br *byteRange) resolve(size int64, done bool) (first, last int64, err error) {
+	if br.suffix {
+		if size == 0 {
+			if done {
+				return 0, 0, errRangeNotSatisfiable
+			}
+			// Nothing written yet, follow the stream from the start.
+			return 0, -1, nil
+		}
+
+		if first = size - br.last; first < 0 {
+			first = 0
+		}
+		return first, size - 1, nil
+	}
+
+	first, last = br.first, br.last
+	if done {
+		if first >= size {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		if last < 0 || last >= size {
+			last = size - 1
+		}
+	}
+	return first, last, nil
+}
+
+// Formats the Content-Range of a resolved range. The complete
+// length is unknown (`*`) until the stream is done, as is the
+// end of an open ended range.
+func contentRange(first, last, size int64, done bool) string {
+	length := "*"
+	if done {
+		length = strconv.FormatInt(size, 10)
+	}
+
+	end := "*"
+	if last >= 0 {
+		end = strconv.FormatInt(last, 10)
+	}
+	return fmt.Sprintf("bytes %d-%s/%s", first, end, length)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	for val, expected := range map[string]*byteRange{
+		"bytes=0-":       {first: 0, last: -1},
+		"bytes=100-":     {first: 100, last: -1},
+		"bytes=100-199":  {first: 100, last: 199},
+		"bytes=5-5":      {first: 5, last: 5},
+		"bytes=-500":     {last: 500, suffix: true},
+		"Bytes= 10 - 20": {first: 10, last: 20},
+		"":               nil,
+		"100-":           nil,
+		"bytes=":         nil,
+		"bytes=-":        nil,
+		"bytes=-0":       nil,
+		"bytes=abc-":     nil,
+		"bytes=20-10":    nil,
+		"bytes=0-1,5-6":  nil,
+		"items=0-10":     nil,
+	} {
+		assert.Equal(t, expected, parseRange(val), val)
+	}
+}
+
+func TestResolveRange(t *testing.T) {
+	testdata := []struct {
+		rng         byteRange
+		size        int64
+		done        bool
+		first, last int64
+		err         error
+	}{
+		{byteRange{first: 0, last: -1}, 10, true, 0, 9, nil},
+		{byteRange{first: 4, last: 100}, 10, true, 4, 9, nil},
+		{byteRange{first: 4, last: 6}, 10, true, 4, 6, nil},
+		{byteRange{first: 10, last: -1}, 10, true, 0, 0, errRangeNotSatisfiable},
+		{byteRange{last: 3, suffix: true}, 10, true, 7, 9, nil},
+		{byteRange{last: 30, suffix: true}, 10, true, 0, 9, nil},
+		{byteRange{last: 3, suffix: true}, 0, true, 0, 0, errRangeNotSatisfiable},
+
+		// Live streams
+		{byteRange{first: 20, last: -1}, 10, false, 20, -1, nil},
+		{byteRange{first: 4, last: 100}, 10, false, 4, 100, nil},
+		{byteRange{last: 3, suffix: true}, 10, false, 7, 9, nil},
+		{byteRange{last: 3, suffix: true}, 0, false, 0, -1, nil},
+	}
+
+	for _, data := range testdata {
+		first, last, err := data.rng.resolve(data.size, data.done)
+		assert.Equal(t, data.err, err)
+		assert.Equal(t, data.first, first)
+		assert.Equal(t, data.last, last)
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	assert.Equal(t, "bytes 0-9/10", contentRange(0, 9, 10, true))
+	assert.Equal(t, "bytes 4-100/*", contentRange(4, 100, 10, false))
+	assert.Equal(t, "bytes 20-*/*", contentRange(20, -1, 10, false))
+}
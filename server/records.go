@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/util"
+)
+
+// Streams declared with this content type hold one JSON
+// record per line. Others are opaque bytes.
+const contentTypeNDJSON = "application/x-ndjson"
+
+// Records can't grow past this without a newline.
+const maxRecordSize = 1 << 20
+
+// Returns the content type requested through the
+// `Stream-Content-Type` header on creation, empty for
+// opaque streams.
+func requestedContentType(r *http.Request) (string, error) {
+	val := r.Header.Get("Stream-Content-Type")
+	if val == "" {
+		return "", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(val)
+	if err != nil {
+		return "", errInvalidContentType
+	}
+
+	switch mediaType {
+	case "application/octet-stream":
+		return "", nil
+	case contentTypeNDJSON:
+		return contentTypeNDJSON, nil
+	}
+	return "", errInvalidContentType
+}
+
+// Returns the content type the channel was registered with,
+// or once it expired from the broker, the one it was stored
+// with.
+func channelContentType(r *http.Request) string {
+	if st, err := broker.GetStatus(key(r)); err == nil {
+		return st.ContentType
+	}
+
+	contentType, err := storage.ContentType(requestURI(r))
+	if err != nil {
+		return ""
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == contentTypeNDJSON {
+		return contentTypeNDJSON
+	}
+	return ""
+}
+
+type recordError struct {
+	offset int64
+	reason string
+}
+
+func (e *recordError) Error() string {
+	return fmt.Sprintf("Invalid record at offset %d: %s.", e.offset, e.reason)
+}
+
+// Frames the data published to an NDJSON stream on newlines,
+// only passing on complete records, each checked to be valid
+// JSON. Returns a *recordError on the first invalid one, once
+// the records before it are written.
+type recordWriter struct {
+	w      io.WriteCloser
+	buf    []byte
+	offset int64 // stream offset of buf
+}
+
+func newRecordWriter(w io.WriteCloser, offset int64) *recordWriter {
+	return &recordWriter{w: w, offset: offset}
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	end := bytes.LastIndexByte(w.buf, '\n') + 1
+	if len(w.buf)-end > maxRecordSize {
+		w.buf = nil
+		return 0, &recordError{w.offset + int64(end), "record too large"}
+	}
+
+	valid := 0
+	for valid < end {
+		i := valid + bytes.IndexByte(w.buf[valid:end], '\n') + 1
+		if !validRecord(w.buf[valid:i]) {
+			break
+		}
+		valid = i
+	}
+
+	if err := w.flush(valid); err != nil {
+		return 0, err
+	}
+	if valid < end {
+		w.buf = nil
+		return 0, &recordError{w.offset, "not JSON"}
+	}
+	return len(p), nil
+}
+
+// Writes out a trailing record left without its newline,
+// adding one.
+func (w *recordWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if !validRecord(w.buf) {
+		return &recordError{w.offset, "not JSON"}
+	}
+
+	w.buf = append(w.buf, '\n')
+	return w.flush(len(w.buf))
+}
+
+func (w *recordWriter) flush(n int) error {
+	if n == 0 {
+		return nil
+	}
+	if _, err := w.w.Write(w.buf[:n]); err != nil {
+		return err
+	}
+
+	util.CountMany("server.pub.records", int64(bytes.Count(w.buf[:n], []byte{'\n'})))
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	w.offset += int64(n)
+	return nil
+}
+
+// Flushes the last record, dropping it when it's invalid.
+func (w *recordWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		util.CountWithData("server.pub.records.dropped", 1, "err=%q", err)
+	}
+	return w.w.Close()
+}
+
+// Blank lines are let through, as subscribers skip them.
+func validRecord(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	return len(line) == 0 || json.Valid(line)
+}
+
+// Parses `field.<path>=<value>` query parameters into a filter
+// on records, where path is a dot separated list of object
+// keys. Records must match every field, and any of the values
+// given for a field. Strings match their value, others their
+// JSON text (e.g. `true`, `42`, `null`). Returns nil when no
+// filter is given.
+func recordFilter(r *http.Request) func(record []byte) bool {
+	fields := map[string][]string{}
+	for param, values := range r.URL.Query() {
+		if path := strings.TrimPrefix(param, "field."); path != param && path != "" {
+			fields[path] = values
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return func(record []byte) bool {
+		var doc interface{}
+		if json.Unmarshal(record, &doc) != nil {
+			return false
+		}
+
+		for path, values := range fields {
+			if !matchField(doc, strings.Split(path, "."), values) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func matchField(doc interface{}, path []string, values []string) bool {
+	doc, ok := lookupField(doc, path)
+	if !ok {
+		return false
+	}
+
+	text, ok := doc.(string)
+	if !ok {
+		encoded, _ := json.Marshal(doc)
+		text = string(encoded)
+	}
+
+	for _, value := range values {
+		if text == value {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupField(doc interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// Parses the `event=<path>` query parameter, naming the event
+// of each record after the string at path, e.g. `event=source`
+// sends the records of busltee's framed mode as `stdout` and
+// `stderr` events. Returns nil when not given.
+func recordEventType(r *http.Request) func(record []byte) string {
+	param := r.URL.Query().Get("event")
+	if param == "" {
+		return nil
+	}
+	path := strings.Split(param, ".")
+
+	return func(record []byte) string {
+		var doc interface{}
+		if json.Unmarshal(record, &doc) != nil {
+			return ""
+		}
+
+		field, _ := lookupField(doc, path)
+		name, _ := field.(string)
+
+		// A line break would end the `event:` field early.
+		return strings.Map(func(c rune) rune {
+			if c == '\r' || c == '\n' {
+				return -1
+			}
+			return c
+		}, name)
+	}
+}
+
+type recordFilterReader struct {
+	records *bufio.Reader
+	keep    func(record []byte) bool
+	pending []byte
+	err     error
+}
+
+// Returns the records of rd that keep accepts, as is.
+func newRecordFilterReader(rd io.Reader, keep func(record []byte) bool) io.Reader {
+	return &recordFilterReader{records: bufio.NewReader(rd), keep: keep}
+}
+
+func (r *recordFilterReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		record, err := r.records.ReadBytes('\n')
+		r.err = err
+		if len(record) > 0 && r.keep(bytes.TrimRight(record, "\r\n")) {
+			r.pending = record
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
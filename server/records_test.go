@@ -0,0 +1,119 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+type recordSink struct {
+	data   []string
+	closed bool
+}
+
+func (s *recordSink) Write(p []byte) (int, error) {
+	s.data = append(s.data, string(p))
+	return len(p), nil
+}
+
+func (s *recordSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestRequestedContentType(t *testing.T) {
+	for val, expected := range map[string]string{
+		"":                                    "",
+		"application/octet-stream":            "",
+		"application/x-ndjson":                contentTypeNDJSON,
+		"application/x-ndjson; charset=utf-8": contentTypeNDJSON,
+		"Application/X-NDJSON":                contentTypeNDJSON,
+	} {
+		r, _ := http.NewRequest("PUT", "/streams/1/2/3", nil)
+		r.Header.Set("Stream-Content-Type", val)
+
+		contentType, err := requestedContentType(r)
+		assert.Nil(t, err, val)
+		assert.Equal(t, expected, contentType, val)
+	}
+
+	r, _ := http.NewRequest("PUT", "/streams/1/2/3", nil)
+	r.Header.Set("Stream-Content-Type", "text/html")
+	_, err := requestedContentType(r)
+	assert.Equal(t, errInvalidContentType, err)
+}
+
+func TestRecordWriter(t *testing.T) {
+	sink := &recordSink{}
+	w := newRecordWriter(sink, 0)
+
+	// Records are only passed on once complete.
+	w.Write([]byte(`{"a":`))
+	assert.Len(t, sink.data, 0)
+	w.Write([]byte("1}\n[2,"))
+	w.Write([]byte("3]\r\n\"four\""))
+	assert.Equal(t, []string{"{\"a\":1}\n", "[2,3]\r\n"}, sink.data)
+
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "\"four\"\n", sink.data[2])
+
+	// Valid records before an invalid one are kept.
+	_, err := w.Write([]byte("{}\nnot json\n{}\n"))
+	assert.Equal(t, "Invalid record at offset 25: not JSON.", err.Error())
+	assert.Equal(t, "{}\n", sink.data[3])
+
+	assert.Nil(t, w.Close())
+	assert.Len(t, sink.data, 4)
+	assert.True(t, sink.closed)
+}
+
+func TestRecordWriterBlankLines(t *testing.T) {
+	sink := &recordSink{}
+	w := newRecordWriter(sink, 0)
+
+	_, err := w.Write([]byte("{}\n\n\r\n[]\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"{}\n\n\r\n[]\n"}, sink.data)
+}
+
+func TestRecordWriterTooLarge(t *testing.T) {
+	w := newRecordWriter(&recordSink{}, 10)
+	_, err := w.Write([]byte(strings.Repeat("1", maxRecordSize+1)))
+	assert.Equal(t, "Invalid record at offset 10: record too large.", err.Error())
+}
+
+func TestRecordFilter(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/streams/1/2/3", nil)
+	assert.Nil(t, recordFilter(r))
+
+	r, _ = http.NewRequest("GET", "/streams/1/2/3?field.level=error&field.level=warn&field.ctx.retry=true&other=1", nil)
+	keep := recordFilter(r)
+
+	assert.True(t, keep([]byte(`{"level":"error","ctx":{"retry":true}}`)))
+	assert.True(t, keep([]byte(`{"level":"warn","ctx":{"retry":true}}`)))
+	assert.False(t, keep([]byte(`{"level":"info","ctx":{"retry":true}}`)))
+	assert.False(t, keep([]byte(`{"level":"error","ctx":{"retry":false}}`)))
+	assert.False(t, keep([]byte(`{"level":"error"}`)))
+	assert.False(t, keep([]byte(`["error"]`)))
+
+	rd := newRecordFilterReader(strings.NewReader("{\"level\":\"error\",\"ctx\":{\"retry\":true}}\n{\"level\":\"info\"}\n"), keep)
+	data, _ := ioutil.ReadAll(rd)
+	assert.Equal(t, "{\"level\":\"error\",\"ctx\":{\"retry\":true}}\n", string(data))
+}
+
+func TestRecordEventType(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/streams/1/2/3", nil)
+	assert.Nil(t, recordEventType(r))
+
+	r, _ = http.NewRequest("GET", "/streams/1/2/3?event=ctx.source", nil)
+	name := recordEventType(r)
+
+	assert.Equal(t, "stderr", name([]byte(`{"ctx":{"source":"stderr"}}`)))
+	assert.Equal(t, "stdout", name([]byte(`{"ctx":{"source":"std\nout"}}`)))
+	assert.Equal(t, "", name([]byte(`{"ctx":{"source":1}}`)))
+	assert.Equal(t, "", name([]byte(`{"source":"stderr"}`)))
+	assert.Equal(t, "", name([]byte(`not json`)))
+}
@@ -6,12 +6,15 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"time"
+	"strconv"
 
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/braintree/manners"
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/gorilla/mux"
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/heroku/rollbar"
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/metrics"
+	"github.com/heroku/busl/redact"
+	"github.com/heroku/busl/storage"
 	"github.com/heroku/busl/util"
 )
 
@@ -23,8 +26,19 @@ func init() {
 	gracefulServer.InnerServer.WriteTimeout = *util.HttpWriteTimeout
 }
 
-func mkstream(w http.ResponseWriter, _ *http.Request) {
-	registrar := broker.NewRedisRegistrar()
+func mkstream(w http.ResponseWriter, r *http.Request) {
+	ttl, err := streamTTL(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	contentType, err := requestedContentType(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
 	uuid, err := util.NewUUID()
 	if err != nil {
 		http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
@@ -33,7 +47,7 @@ func mkstream(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 
-	if err := registrar.Register(uuid); err != nil {
+	if err := broker.RegisterWithType(uuid, ttl, contentType); err != nil {
 		http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
 		rollbar.Error(rollbar.ERR, fmt.Errorf("unable to register stream: %#v", err))
 		util.CountWithData("mkstream.create.fail", 1, "error=%s", err)
@@ -41,22 +55,76 @@ func mkstream(w http.ResponseWriter, _ *http.Request) {
 	}
 
 	util.Count("mkstream.create.success")
+	w.Header().Set("Stream-TTL", strconv.Itoa(int(ttl.Seconds())))
+	if contentType != "" {
+		w.Header().Set("Stream-Content-Type", contentType)
+	}
+	issueTokens(w, string(uuid))
 	io.WriteString(w, string(uuid))
 }
 
 func put(w http.ResponseWriter, r *http.Request) {
-	registrar := broker.NewRedisRegistrar()
+	ttl, err := streamTTL(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
 
-	if err := registrar.Register(key(r)); err != nil {
+	contentType, err := requestedContentType(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if err := broker.RegisterWithType(key(r), ttl, contentType); err != nil {
 		http.Error(w, "Unable to create stream. Please try again.", http.StatusServiceUnavailable)
 		rollbar.Error(rollbar.ERR, fmt.Errorf("unable to register stream: %#v", err))
 		util.CountWithData("put.create.fail", 1, "error=%s", err)
 		return
 	}
 	util.Count("put.create.success")
+	w.Header().Set("Stream-TTL", strconv.Itoa(int(ttl.Seconds())))
+	if contentType != "" {
+		w.Header().Set("Stream-Content-Type", contentType)
+	}
+	issueTokens(w, key(r))
 	w.WriteHeader(http.StatusCreated)
 }
 
+// Removes the stream from the broker, disconnecting any
+// subscribers. With a `Delete-Storage: true` header, the
+// copy persisted in the storage backend is removed as well.
+func del(w http.ResponseWriter, r *http.Request) {
+	err := broker.Unregister(key(r))
+	if err != nil && err != broker.ErrNotRegistered {
+		http.Error(w, "Unable to delete stream. Please try again.", http.StatusServiceUnavailable)
+		rollbar.Error(rollbar.ERR, fmt.Errorf("unable to unregister stream: %#v", err))
+		util.CountWithData("delete.fail", 1, "error=%s", err)
+		return
+	}
+	found := err == nil
+
+	if r.Header.Get("Delete-Storage") == "true" {
+		switch err := storage.Delete(requestURI(r)); err {
+		case nil:
+			found = true
+		case storage.ErrNotFound, storage.ErrNoStorage:
+		default:
+			http.Error(w, "Unable to delete stream. Please try again.", http.StatusServiceUnavailable)
+			util.CountWithData("delete.storage.fail", 1, "error=%s", err)
+			return
+		}
+	}
+
+	if !found {
+		handleError(w, r, broker.ErrNotRegistered)
+		return
+	}
+
+	util.Count("delete.success")
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func health(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK")
 }
@@ -67,34 +135,63 @@ func pub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writer, err := broker.NewWriter(key(r))
+	offset, err := requestedOffset(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if offset >= 0 {
+		if err := skipCommitted(r.Body, key(r), offset); err != nil {
+			setCommittedLength(w, key(r))
+			handleError(w, r, err)
+			return
+		}
+	}
+
+	writer, err := newPublishWriter(key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
-	defer writer.Close()
+	// Deferred first, so it runs once the writer is closed.
+	defer setCommittedLength(w, key(r))
+
+	activePublishers.Inc()
+	defer activePublishers.Dec()
 
 	body := bufio.NewReader(r.Body)
 	defer r.Body.Close()
 
+	channel, uri := captureVars(r, requestURI)
+
+	// The writer is closed before the final store, so
+	// the data it holds back gets stored too.
 	done := make(chan struct{})
+	defer func() {
+		writer.Close()
+		close(done)
+		storeFinal(channel, uri)
+	}()
 
-	go func() {
-		for {
-			select {
-			case <-done:
-				// Asynchronously upload the output to our defined storage backend.
-				go storeOutput(key(r), requestURI(r))
-				return
-			case <-time.After(*util.StorageInterval):
-				// Asynchronously upload the output to our defined storage backend.
-				go storeOutput(key(r), requestURI(r))
-			}
-		}
+	go storePeriodically(channel, uri, done)
 
-	}()
+	_, err = io.Copy(&instrumentedWriter{writer}, body)
+	if records, ok := writer.(*recordWriter); ok && err == nil {
+		err = records.Flush()
+	}
 
-	_, err = io.Copy(writer, body)
+	if err, ok := err.(*recordError); ok {
+		util.CountWithData("server.pub.records.invalid", 1, "err=%q", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The stream may be deleted while it's being published to.
+	if err == broker.ErrStreamFull || err == broker.ErrNotRegistered {
+		handleError(w, r, err)
+		return
+	}
 
 	if err == io.ErrUnexpectedEOF {
 		util.CountWithData("server.pub.read.eoferror", 1, "msg=\"%v\"", err.Error())
@@ -107,8 +204,34 @@ func pub(w http.ResponseWriter, r *http.Request) {
 		rollbar.Error(rollbar.ERR, fmt.Errorf("unhandled error: %#v", err))
 		return
 	}
+}
 
-	close(done)
+// Opens the broker writer of a channel for publishing, masking
+// secrets out of the data when redaction is configured, and
+// checking records of NDJSON streams.
+func newPublishWriter(channel string) (io.WriteCloser, error) {
+	redactor, err := redact.Configured()
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := broker.GetStatus(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := broker.NewWriter(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	if redactor != nil {
+		writer = redactor.NewWriter(writer)
+	}
+	if st.ContentType == contentTypeNDJSON {
+		writer = newRecordWriter(writer, st.Size)
+	}
+	return writer, nil
 }
 
 func sub(w http.ResponseWriter, r *http.Request) {
@@ -117,6 +240,8 @@ func sub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("Accept-Ranges", "bytes")
+
 	rd, err := newReader(w, r)
 	if rd != nil {
 		defer rd.Close()
@@ -125,6 +250,17 @@ func sub(w http.ResponseWriter, r *http.Request) {
 		handleError(w, r, err)
 		return
 	}
+
+	activeSubscribers.Inc()
+	defer activeSubscribers.Dec()
+
+	// Ranges address the raw bytes, and were answered as such.
+	if w.Header().Get("Content-Range") == "" {
+		gw, closeGzip := newGzipResponseWriter(w, r)
+		defer closeGzip()
+		w = gw
+	}
+
 	io.Copy(newWriteFlusher(w), rd)
 }
 
@@ -132,21 +268,29 @@ func app() http.Handler {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/health", addDefaultHeaders(health))
+	r.HandleFunc("/metrics", metrics.Handler)
 
 	// Legacy endpoint for creating the uuid `key` for you.
 	r.HandleFunc("/streams", auth(addDefaultHeaders(mkstream)))
 
 	// New `key` design for allowing any kind of id to be decided
 	// by the caller (in this case, it mirrors what we have in S3).
-	r.HandleFunc("/streams/{key:.+}", addDefaultHeaders(sub)).Methods("GET")
-	r.HandleFunc("/streams/{key:.+}", addDefaultHeaders(pub)).Methods("POST")
+	r.HandleFunc("/streams/{key:.+}/status", addDefaultHeaders(authorizeAny([]string{permRead, permPublish}, status))).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}/ws", addDefaultHeaders(ws)).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}", addDefaultHeaders(authorizeAny([]string{permRead, permPublish}, head))).Methods("HEAD")
+	r.HandleFunc("/streams/{key:.+}", addDefaultHeaders(authorize(permRead, sub))).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}", addDefaultHeaders(authorize(permPublish, pub))).Methods("POST")
 	r.HandleFunc("/streams/{key:.+}", auth(addDefaultHeaders(put))).Methods("PUT")
+	r.HandleFunc("/streams/{key:.+}", auth(addDefaultHeaders(del))).Methods("DELETE")
 
 	return logRequest(enforceHTTPS(r.ServeHTTP))
 }
 
 func Start(port string, shutdown <-chan struct{}) {
 	log.Printf("http.start.port=%s\n", port)
+	if _, err := redact.Configured(); err != nil {
+		log.Fatalf("server.redact error=%v", err)
+	}
 	http.Handle("/", app())
 	go listenForShutdown(shutdown)
 
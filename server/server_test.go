@@ -2,19 +2,34 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
 	"github.com/heroku/busl/util"
+	"github.com/heroku/busl/websocket"
 )
 
 var baseURL = *util.StorageBaseURL
 
+func init() {
+	// Run the server against the in-process broker so
+	// the tests don't depend on a redis instance.
+	broker.SetDefault(broker.NewMemoryBroker())
+}
+
 func TestMkstream(t *testing.T) {
 	request, _ := http.NewRequest("POST", "/streams", nil)
 	response := httptest.NewRecorder()
@@ -129,13 +144,13 @@ func TestPubSubSSE(t *testing.T) {
 		input  string
 		output string
 	}{
-		{0, "hello", "id: 5\ndata: hello\n\n"},
-		{0, "hello\n", "id: 6\ndata: hello\ndata: \n\n"},
-		{0, "hello\nworld", "id: 11\ndata: hello\ndata: world\n\n"},
-		{0, "hello\nworld\n", "id: 12\ndata: hello\ndata: world\ndata: \n\n"},
-		{1, "hello\nworld\n", "id: 12\ndata: ello\ndata: world\ndata: \n\n"},
-		{6, "hello\nworld\n", "id: 12\ndata: world\ndata: \n\n"},
-		{11, "hello\nworld\n", "id: 12\ndata: \ndata: \n\n"},
+		{0, "hello", "id: 5\ndata: hello\n\nevent: end\ndata: 5\n\n"},
+		{0, "hello\n", "id: 6\ndata: hello\ndata: \n\nevent: end\ndata: 6\n\n"},
+		{0, "hello\nworld", "id: 11\ndata: hello\ndata: world\n\nevent: end\ndata: 11\n\n"},
+		{0, "hello\nworld\n", "id: 12\ndata: hello\ndata: world\ndata: \n\nevent: end\ndata: 12\n\n"},
+		{1, "hello\nworld\n", "id: 12\ndata: ello\ndata: world\ndata: \n\nevent: end\ndata: 12\n\n"},
+		{6, "hello\nworld\n", "id: 12\ndata: world\ndata: \n\nevent: end\ndata: 12\n\n"},
+		{11, "hello\nworld\n", "id: 12\ndata: \ndata: \n\nevent: end\ndata: 12\n\n"},
 		{12, "hello\nworld\n", ""},
 	}
 
@@ -200,8 +215,360 @@ func TestPut(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, resp.StatusCode, http.StatusCreated)
 
-	registrar := broker.NewRedisRegistrar()
-	assert.True(t, registrar.IsRegistered("1/2/3"))
+	assert.True(t, broker.IsRegistered("1/2/3"))
+}
+
+func TestPubStreamFull(t *testing.T) {
+	*util.MaxStreamSize = 5
+	defer func() {
+		*util.MaxStreamSize = 0
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+
+	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewReader([]byte("hello world")))
+	request.TransferEncoding = []string{"chunked"}
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestPubRedacted(t *testing.T) {
+	*util.RedactSecrets = "hunter2"
+	*util.RedactPatterns = `AKIA[0-9A-Z]{16}`
+	defer func() {
+		*util.RedactSecrets = ""
+		*util.RedactPatterns = ""
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+
+	// Secrets split across chunks are masked all the same.
+	rd, wr := io.Pipe()
+	go func() {
+		for _, chunk := range []string{"password: hun", "ter2\nkey: AKIAIOSF", "ODNN7EXAMPLE\n", "done"} {
+			wr.Write([]byte(chunk))
+			time.Sleep(10 * time.Millisecond)
+		}
+		wr.Close()
+	}()
+
+	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, rd)
+	request.TransferEncoding = []string{"chunked"}
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "password: *******\nkey: ********************\ndone", string(body))
+}
+
+func TestPubOffset(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+
+	publish := func(offset, data string) *http.Response {
+		request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewReader([]byte(data)))
+		request.TransferEncoding = []string{"chunked"}
+		if offset != "" {
+			request.Header.Set("Stream-Offset", offset)
+		}
+		resp, err := client.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := publish("0", "hello")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Stream-Committed-Length"))
+
+	// Resending what's already there only appends the rest.
+	resp = publish("2", "llo world")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "11", resp.Header.Get("Stream-Committed-Length"))
+
+	resp = publish("0", "hello")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "11", resp.Header.Get("Stream-Committed-Length"))
+
+	resp = publish("20", "!")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "11", resp.Header.Get("Stream-Committed-Length"))
+
+	resp = publish("-1", "!")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello world", string(body))
+}
+
+func TestPubSubRecords(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	url := server.URL + "/streams/records"
+
+	request, _ := http.NewRequest("PUT", url, nil)
+	request.Header.Set("Stream-Content-Type", "application/x-ndjson")
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Stream-Content-Type"))
+
+	// Records up to the invalid one are kept.
+	input := "{\"level\":\"info\"}\n{\"level\":\"error\"}\nnot json\n{}\n"
+	request, _ = http.NewRequest("POST", url, strings.NewReader(input))
+	request.TransferEncoding = []string{"chunked"}
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Invalid record at offset 35: not JSON.\n", string(body))
+
+	request, _ = http.NewRequest("GET", url, nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "id: 17\ndata: {\"level\":\"info\"}\n\nid: 35\ndata: {\"level\":\"error\"}\n\nevent: end\ndata: 35\n\n", string(body))
+
+	request, _ = http.NewRequest("GET", url+"?event=level", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Last-Event-ID", "17")
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "id: 35\nevent: error\ndata: {\"level\":\"error\"}\n\nevent: end\ndata: 35\n\n", string(body))
+
+	request, _ = http.NewRequest("GET", url+"?field.level=error", nil)
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "{\"level\":\"error\"}\n", string(body))
+
+	request, _ = http.NewRequest("PUT", url, nil)
+	request.Header.Set("Stream-Content-Type", "text/html")
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
+
+func TestPutTTL(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	testdata := []struct {
+		header string
+		query  string
+		status int
+		ttl    string
+	}{
+		{"", "", http.StatusCreated, "300"},
+		{"60", "", http.StatusCreated, "60"},
+		{"1h", "", http.StatusCreated, "3600"},
+		{"", "ttl=90", http.StatusCreated, "90"},
+		{"120", "ttl=90", http.StatusCreated, "120"},
+		{"1000h", "", http.StatusCreated, "86400"},
+		{"-1", "", http.StatusBadRequest, ""},
+		{"forever", "", http.StatusBadRequest, ""},
+	}
+
+	for _, data := range testdata {
+		request, _ := http.NewRequest("PUT", server.URL+"/streams/1/2/3?"+data.query, nil)
+		if data.header != "" {
+			request.Header.Set("Stream-TTL", data.header)
+		}
+		resp, err := client.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, data.status, resp.StatusCode)
+		assert.Equal(t, data.ttl, resp.Header.Get("Stream-TTL"))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+
+	done := make(chan bool)
+	go func() {
+		// An active subscriber gets disconnected.
+		resp, err := http.Get(server.URL + "/streams/" + uuid)
+		assert.Nil(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- true
+	}()
+
+	// Give the subscriber a chance to connect.
+	time.Sleep(50 * time.Millisecond)
+
+	request, _ := http.NewRequest("DELETE", server.URL+"/streams/"+uuid, nil)
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.False(t, broker.IsRegistered(uuid))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("subscriber wasn't disconnected")
+	}
+
+	request, _ = http.NewRequest("DELETE", server.URL+"/streams/"+uuid, nil)
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDeleteWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	deleted := make(chan bool, 1)
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" && r.URL.Path == "/"+uuid {
+			deleted <- true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer storage.Close()
+
+	*util.StorageBaseURL = storage.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	// Not in the broker anymore, but still in storage.
+	request, _ := http.NewRequest("DELETE", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Delete-Storage", "true")
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.True(t, <-deleted)
+}
+
+func TestStatus(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	broker.Register("1/2/3", time.Minute)
+	w, _ := broker.NewWriter("1/2/3")
+	w.Write([]byte("hello"))
+
+	r, _ := broker.NewReader("1/2/3")
+	defer r.Close()
+
+	request, _ := http.NewRequest("HEAD", server.URL+"/streams/1/2/3", nil)
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "false", resp.Header.Get("Stream-Done"))
+	assert.Equal(t, "broker", resp.Header.Get("Stream-Source"))
+	assert.NotEmpty(t, resp.Header.Get("Expires"))
+
+	w.Close()
+
+	resp, err = http.Get(server.URL + "/streams/1/2/3/status")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var status map[string]interface{}
+	assert.Nil(t, json.Unmarshal(body, &status))
+	assert.Equal(t, float64(5), status["size"])
+	assert.Equal(t, true, status["done"])
+	assert.Equal(t, float64(1), status["subscribers"])
+	assert.Equal(t, "broker", status["source"])
+	assert.True(t, status["ttl"].(float64) > 0)
+
+	resp, err = http.Get(server.URL + "/streams/4/5/6/status")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStatusWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	storage, get, _ := fileServer(uuid)
+	defer storage.Close()
+
+	*util.StorageBaseURL = storage.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	get <- []byte("hello world")
+
+	request, _ := http.NewRequest("HEAD", server.URL+"/streams/"+uuid, nil)
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "11", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "true", resp.Header.Get("Stream-Done"))
+	assert.Equal(t, "storage", resp.Header.Get("Stream-Source"))
 }
 
 func TestSubGoneWithBackend(t *testing.T) {
@@ -218,6 +585,8 @@ func TestSubGoneWithBackend(t *testing.T) {
 	server := httptest.NewServer(app())
 	defer server.Close()
 
+	// Once for the data, once for its content type.
+	get <- []byte("hello world")
 	get <- []byte("hello world")
 
 	resp, err := http.Get(server.URL + "/streams/" + uuid)
@@ -228,6 +597,74 @@ func TestSubGoneWithBackend(t *testing.T) {
 	assert.Equal(t, body, []byte("hello world"))
 }
 
+func TestSubSSEEvents(t *testing.T) {
+	*util.SSERetry = 2 * time.Second
+	*util.MaxStreamSize = 5
+	*util.StreamOverflow = broker.OverflowTruncate
+	defer func() {
+		*util.SSERetry = 0
+		*util.MaxStreamSize = 0
+		*util.StreamOverflow = broker.OverflowReject
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+
+	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, strings.NewReader("hello world"))
+	request.TransferEncoding = []string{"chunked"}
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	request, _ = http.NewRequest("GET", server.URL+"/streams/"+uuid+"?meta=true", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, "retry: 2000\n\n"+
+		"event: source\ndata: broker\n\n"+
+		"id: 5\ndata: hello\n\n"+
+		"event: truncated\ndata: 5\n\n"+
+		"event: end\ndata: 5\n\n", string(body))
+}
+
+func TestSubSSEEventsWithBackend(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	storage, get, _ := fileServer(uuid)
+	defer storage.Close()
+
+	*util.StorageBaseURL = storage.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	// Once for the data, once for its content type.
+	get <- []byte("hello world")
+	get <- []byte("hello world")
+
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?meta=true", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, "event: source\ndata: storage\n\n"+
+		"id: 11\ndata: hello world\n\n"+
+		"event: end\ndata: 11\n\n", string(body))
+}
+
 func TestPutWithBackend(t *testing.T) {
 	uuid, _ := util.NewUUID()
 
@@ -245,8 +682,7 @@ func TestPutWithBackend(t *testing.T) {
 	transport := &http.Transport{}
 	client := &http.Client{Transport: transport}
 
-	registrar := broker.NewRedisRegistrar()
-	registrar.Register(uuid)
+	broker.Register(uuid, 0)
 
 	// uuid = curl -XPUT <url>/streams/1/2/3
 	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewReader([]byte("hello world")))
@@ -258,6 +694,476 @@ func TestPutWithBackend(t *testing.T) {
 	assert.Equal(t, <-put, []byte("hello world"))
 }
 
+func TestPubStoresBeforeResponding(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	storage, _, put := fileServer(uuid)
+	defer storage.Close()
+
+	*util.StorageBaseURL = storage.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	broker.Register(uuid, 0)
+
+	// A graceful shutdown waits for the response, so the last
+	// segment must be stored by then.
+	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, strings.NewReader("hello world"))
+	request.TransferEncoding = []string{"chunked"}
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case b := <-put:
+		assert.Equal(t, "hello world", string(b))
+	default:
+		t.Fatalf("Expected the output to be stored before the response")
+	}
+}
+
+func TestPutRedactedWithBackend(t *testing.T) {
+	*util.RedactSecrets = "hunter2"
+	defer func() {
+		*util.RedactSecrets = ""
+	}()
+
+	uuid, _ := util.NewUUID()
+
+	storage, _, put := fileServer(uuid)
+	defer storage.Close()
+
+	*util.StorageBaseURL = storage.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	broker.Register(uuid, 0)
+
+	// The incomplete line held back by redaction is stored too.
+	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, strings.NewReader("hello\npassword: hunter2"))
+	request.TransferEncoding = []string{"chunked"}
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello\npassword: *******", string(<-put))
+}
+
+func TestSubRange(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("busl hello world"))
+	writer.Close()
+
+	testdata := []struct {
+		rng          string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"bytes=0-", http.StatusPartialContent, "bytes 0-15/16", "busl hello world"},
+		{"bytes=5-9", http.StatusPartialContent, "bytes 5-9/16", "hello"},
+		{"bytes=10-100", http.StatusPartialContent, "bytes 10-15/16", " world"},
+		{"bytes=-5", http.StatusPartialContent, "bytes 11-15/16", "world"},
+		{"bytes=16-", http.StatusRequestedRangeNotSatisfiable, "bytes */16", ""},
+		{"bytes=0-1,5-6", http.StatusOK, "", "busl hello world"},
+		{"10-", http.StatusOK, "", " world"},
+	}
+
+	for _, data := range testdata {
+		request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+		request.Header.Add("Range", data.rng)
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, data.status, resp.StatusCode, data.rng)
+		assert.Equal(t, data.contentRange, resp.Header.Get("Content-Range"), data.rng)
+		assert.Equal(t, data.body, string(body), data.rng)
+	}
+}
+
+func TestSubRangeLive(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+	writer, _ := broker.NewWriter(uuid)
+	defer writer.Close()
+	writer.Write([]byte("busl"))
+
+	done := make(chan string)
+	go func() {
+		request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+		request.Header.Add("Range", "bytes=2-7")
+		resp, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "bytes 2-7/*", resp.Header.Get("Content-Range"))
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		done <- string(body)
+	}()
+
+	// The range completes before the stream does.
+	writer.Write([]byte(" hello world"))
+	assert.Equal(t, "sl hel", <-done)
+}
+
+func TestSubGzip(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("hello"))
+
+	// Ask for gzip ourselves, so the transport leaves it be.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	request, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Add("Accept-Encoding", "gzip")
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	assert.Nil(t, err)
+
+	// Chunks are flushed while the stream is still live.
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(gz, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	writer.Write([]byte(" world"))
+	writer.Close()
+
+	rest, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, " world", string(rest))
+}
+
+func readWebSocket(conn *websocket.Conn) (string, error) {
+	var buf []byte
+	for {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			return string(buf), err
+		}
+		buf = append(buf, p...)
+	}
+}
+
+func TestWebSocketPubSub(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/streams/" + uuid + "/ws"
+
+	sub, _, err := websocket.Dial(url+"?mode=text", nil)
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	done := make(chan string)
+	go func() {
+		buf, _ := readWebSocket(sub)
+		done <- buf
+	}()
+
+	pub, _, err := websocket.Dial(url, nil)
+	assert.Nil(t, err)
+	defer pub.Close()
+
+	pub.WriteMessage(websocket.BinaryMessage, []byte("hello"))
+	pub.WriteMessage(websocket.TextMessage, []byte(" world"))
+	pub.WriteClose(websocket.CloseNormal, "")
+
+	assert.Equal(t, "hello world", <-done)
+}
+
+func TestWebSocketOffset(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("busl hello world"))
+	writer.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/streams/" + uuid + "/ws"
+
+	for offset, expected := range map[string]string{
+		"0":  "busl hello world",
+		"10": " world",
+		"16": "",
+	} {
+		conn, _, err := websocket.Dial(url+"?offset="+offset, nil)
+		assert.Nil(t, err)
+
+		buf, err := readWebSocket(conn)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, expected, buf)
+		conn.Close()
+	}
+}
+
+func TestWebSocketNotRegistered(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/streams/1/2/3/4/ws"
+	conn, _, err := websocket.Dial(url, nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	buf, err := readWebSocket(conn)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "", buf)
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	*util.WebSocketOrigins = "https://app.example.com, ci.example.com"
+	defer func() { *util.WebSocketOrigins = "" }()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/streams/" + uuid + "/ws"
+
+	for origin, status := range map[string]int{
+		server.URL:                 http.StatusSwitchingProtocols,
+		"https://app.example.com":  http.StatusSwitchingProtocols,
+		"http://ci.example.com":    http.StatusSwitchingProtocols,
+		"https://evil.example.com": http.StatusForbidden,
+		"http://app.example.com":   http.StatusForbidden,
+	} {
+		conn, resp, _ := websocket.Dial(url, http.Header{"Origin": {origin}})
+		assert.Equal(t, status, resp.StatusCode, origin)
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestStreamTokens(t *testing.T) {
+	*util.TokenSecret = "secret"
+	defer func() {
+		*util.TokenSecret = ""
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/1/2/3/tokens", nil)
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	publishToken := resp.Header.Get("Stream-Publish-Token")
+	readToken := resp.Header.Get("Stream-Read-Token")
+	assert.NotEmpty(t, publishToken)
+	assert.NotEmpty(t, readToken)
+
+	publish := func(token string) int {
+		request, _ := http.NewRequest("POST", server.URL+"/streams/1/2/3/tokens", bytes.NewReader([]byte("hello")))
+		request.TransferEncoding = []string{"chunked"}
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, publish(""))
+	assert.Equal(t, http.StatusForbidden, publish(readToken))
+	assert.Equal(t, http.StatusOK, publish(publishToken))
+
+	for token, status := range map[string]int{
+		"":           http.StatusUnauthorized,
+		"invalid":    http.StatusUnauthorized,
+		publishToken: http.StatusForbidden,
+		readToken:    http.StatusOK,
+	} {
+		resp, err := http.Get(server.URL + "/streams/1/2/3/tokens?token=" + token)
+		assert.Nil(t, err)
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, status, resp.StatusCode)
+		if status == http.StatusOK {
+			assert.Equal(t, "hello", string(body))
+		}
+	}
+
+	// Publishers may look up how much of the stream got in.
+	for token, status := range map[string]int{
+		"":           http.StatusUnauthorized,
+		publishToken: http.StatusOK,
+		readToken:    http.StatusOK,
+	} {
+		resp, err := http.Head(server.URL + "/streams/1/2/3/tokens?token=" + token)
+		assert.Nil(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, status, resp.StatusCode)
+		if status == http.StatusOK {
+			assert.Equal(t, int64(5), resp.ContentLength)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+
+	request, _ := http.NewRequest("POST", server.URL+"/streams/"+uuid, bytes.NewReader([]byte("hello")))
+	request.TransferEncoding = []string{"chunked"}
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/metrics")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "# TYPE busl_publishers_active gauge\nbusl_publishers_active 0\n")
+	assert.Contains(t, string(body), "# TYPE busl_write_size_bytes histogram\n")
+	assert.Contains(t, string(body), "# TYPE busl_http_status_2xx_total counter\n")
+}
+
+func TestStoreOutputIncremental(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "busl-storage")
+	defer os.RemoveAll(dir)
+
+	*util.StorageBaseURL = "file://" + dir
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	uuid, _ := util.NewUUID()
+	broker.Register(uuid, 0)
+	writer, _ := broker.NewWriter(uuid)
+
+	writer.Write([]byte("hello"))
+	storeOutput(uuid, uuid)
+
+	// Nothing new, nothing uploaded.
+	storeOutput(uuid, uuid)
+
+	writer.Write([]byte(" world"))
+	writer.Close()
+	storeOutput(uuid, uuid)
+	forgetPersister(uuid)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+	_, err := os.Stat(filepath.Join(dir, uuid+".segment.5.stream"))
+	assert.Nil(t, err)
+
+	rd, err := storage.Get(uuid, 0)
+	assert.Nil(t, err)
+	buf, _ := ioutil.ReadAll(rd)
+	rd.Close()
+	assert.Equal(t, "hello world", string(buf))
+
+	// A reset stream is uploaded again from the start.
+	broker.Register(uuid, 0)
+	writer, _ = broker.NewWriter(uuid)
+	writer.Write([]byte("bye"))
+	storeOutput(uuid, uuid)
+
+	size, _ := storage.Size(uuid)
+	assert.Equal(t, int64(3), size)
+}
+
+func TestSubRecordsFromStorage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "busl-storage")
+	defer os.RemoveAll(dir)
+
+	*util.StorageBaseURL = "file://" + dir
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	server := httptest.NewServer(app())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+
+	request, _ := http.NewRequest("PUT", url, nil)
+	request.Header.Set("Stream-Content-Type", "application/x-ndjson")
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	// Blank lines are let through.
+	input := "{\"level\":\"info\"}\n\r\n{\"level\":\"error\"}\n"
+	request, _ = http.NewRequest("POST", url, strings.NewReader(input))
+	request.TransferEncoding = []string{"chunked"}
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	storeOutput(uuid, uuid)
+	forgetPersister(uuid)
+	broker.Unregister(uuid)
+
+	// Records are still framed once served from storage.
+	request, _ = http.NewRequest("GET", url+"?event=level&field.level=error", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "id: 37\nevent: error\ndata: {\"level\":\"error\"}\n\nevent: end\ndata: 37\n\n", string(body))
+}
+
 func TestAuthentication(t *testing.T) {
 	*util.Creds = "u:pass1|u:pass2"
 	defer func() {
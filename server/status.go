@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+)
+
+type streamStatus struct {
+	Size        int64  `json:"size"`
+	Done        bool   `json:"done"`
+	Truncated   bool   `json:"truncated"`
+	TTL         int64  `json:"ttl"` // seconds left before expiry
+	Subscribers int64  `json:"subscribers"`
+	Source      string `json:"source"` // broker or storage
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Looks the stream up in the broker, falling back to
+// the storage backend once it has expired from there.
+func lookupStatus(r *http.Request) (*streamStatus, error) {
+	st, err := broker.GetStatus(key(r))
+	if err == nil {
+		return &streamStatus{
+			Size:        st.Size,
+			Done:        st.Done,
+			Truncated:   st.Truncated,
+			TTL:         int64(st.TTL / time.Second),
+			Subscribers: st.Subscribers,
+			Source:      "broker",
+			ContentType: st.ContentType,
+		}, nil
+	}
+
+	if err != broker.ErrNotRegistered {
+		return nil, err
+	}
+
+	size, err := storage.Size(requestURI(r))
+	if err != nil {
+		return nil, err
+	}
+
+	// Persisted streams are final.
+	return &streamStatus{Size: size, Done: true, Source: "storage"}, nil
+}
+
+func head(w http.ResponseWriter, r *http.Request) {
+	st, err := lookupStatus(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(st.Size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Stream-Done", strconv.FormatBool(st.Done))
+	w.Header().Set("Stream-Truncated", strconv.FormatBool(st.Truncated))
+	w.Header().Set("Stream-Source", st.Source)
+	if st.ContentType != "" {
+		w.Header().Set("Stream-Content-Type", st.ContentType)
+	}
+
+	if st.TTL > 0 {
+		w.Header().Set("Stream-TTL-Remaining", strconv.FormatInt(st.TTL, 10))
+		w.Header().Set("Expires", time.Now().Add(time.Duration(st.TTL)*time.Second).UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func status(w http.ResponseWriter, r *http.Request) {
+	st, err := lookupStatus(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+// Rights a stream token grants. They're issued separately, so
+// a read-only URL can be handed out while publishing stays
+// with whoever created the stream.
+const (
+	permPublish = "pub"
+	permRead    = "sub"
+)
+
+var (
+	errInvalidToken = errors.New("Invalid or expired stream token.")
+	errForbidden    = errors.New("Stream token doesn't grant this permission.")
+)
+
+func tokensEnabled() bool {
+	return *util.TokenSecret != ""
+}
+
+// Issues a token granting perm on the stream key until expires.
+//
+// Format: <perm>.<expiry unix timestamp>.<signature>
+func newToken(key, perm string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return perm + "." + exp + "." + signToken(key, perm, exp)
+}
+
+func signToken(key, perm, exp string) string {
+	mac := hmac.New(sha256.New, []byte(*util.TokenSecret))
+	io.WriteString(mac, key+"\n"+perm+"\n"+exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks that token is a valid, unexpired token for
+// the stream key, granting perm.
+func verifyToken(key, perm, token string) error {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return errInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(signToken(key, parts[0], parts[1]))) {
+		return errInvalidToken
+	}
+
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return errInvalidToken
+	}
+
+	if parts[0] != perm {
+		return errForbidden
+	}
+	return nil
+}
+
+// Sets the publish and read tokens of a newly created stream.
+func issueTokens(w http.ResponseWriter, key string) {
+	if !tokensEnabled() {
+		return
+	}
+
+	expires := time.Now().Add(*util.TokenTTL)
+	w.Header().Set("Stream-Publish-Token", newToken(key, permPublish, expires))
+	w.Header().Set("Stream-Read-Token", newToken(key, permRead, expires))
+}
+
+// Returns the token given as `Authorization: Bearer <token>`,
+// or through the `token` query parameter for clients that
+// can't set headers (e.g. EventSource).
+func requestToken(r *http.Request) string {
+	if val := r.Header.Get("Authorization"); len(val) > 7 && strings.EqualFold(val[:7], "bearer ") {
+		return strings.TrimSpace(val[7:])
+	}
+	return r.URL.Query().Get("token")
+}
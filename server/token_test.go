@@ -0,0 +1,35 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/heroku/busl/util"
+)
+
+func TestVerifyToken(t *testing.T) {
+	*util.TokenSecret = "secret"
+	defer func() {
+		*util.TokenSecret = ""
+	}()
+
+	expires := time.Now().Add(time.Minute)
+	token := newToken("1/2/3", permRead, expires)
+
+	assert.Nil(t, verifyToken("1/2/3", permRead, token))
+	assert.Equal(t, errForbidden, verifyToken("1/2/3", permPublish, token))
+	assert.Equal(t, errInvalidToken, verifyToken("4/5/6", permRead, token))
+
+	// Tampering with any part invalidates the signature.
+	tampered := strings.Replace(token, permRead+".", permPublish+".", 1)
+	assert.Equal(t, errInvalidToken, verifyToken("1/2/3", permPublish, tampered))
+
+	for _, token := range []string{"", "sub", "sub.123", newToken("1/2/3", permRead, time.Now().Add(-time.Minute))} {
+		assert.Equal(t, errInvalidToken, verifyToken("1/2/3", permRead, token))
+	}
+
+	*util.TokenSecret = "other"
+	assert.Equal(t, errInvalidToken, verifyToken("1/2/3", permRead, token))
+}
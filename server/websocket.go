@@ -0,0 +1,240 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+	"github.com/heroku/busl/websocket"
+)
+
+// Application specific close codes, mirroring the HTTP statuses
+// the regular endpoints respond with.
+const (
+	closeInvalidRecord = 4400
+	closeForbidden     = 4403
+	closeNotFound      = 4404
+	closeStreamFull    = 4413
+	closeUnavailable   = 4503
+)
+
+// Streams the channel over a websocket. Frames are binary by
+// default, `?mode=text` sends text frames instead. Subscribers
+// resume from `?offset=N` (or the usual Last-Event-ID / Range
+// headers).
+//
+// Messages sent by the client are published to the channel.
+// The channel is marked done once the client closes the socket.
+//
+// With stream tokens enabled, a read token subscribes and a
+// publish token allows sending messages.
+func ws(w http.ResponseWriter, r *http.Request) {
+	channel, uri := captureVars(r, wsRequestURI)
+
+	canRead, canPublish := true, true
+	if tokensEnabled() {
+		token := requestToken(r)
+		readErr := verifyToken(channel, permRead, token)
+		publishErr := verifyToken(channel, permPublish, token)
+
+		if readErr != nil && publishErr != nil {
+			handleError(w, r, readErr)
+			return
+		}
+		canRead, canPublish = readErr == nil, publishErr == nil
+	}
+
+	messageType := websocket.BinaryMessage
+	if r.URL.Query().Get("mode") == "text" {
+		messageType = websocket.TextMessage
+	}
+
+	off := offset(r)
+	if val := r.URL.Query().Get("offset"); val != "" {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset.", http.StatusBadRequest)
+			return
+		}
+		off = n
+	}
+
+	conn, err := websocket.Upgrade(w, r, webSocketOrigins())
+	if err != nil {
+		util.CountWithData("server.ws.upgrade.error", 1, "err=%s", err)
+		return
+	}
+	defer conn.Close()
+	util.Count("server.ws.connect")
+
+	// Closed once the client goes away.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		wsPublish(conn, channel, uri, canPublish)
+	}()
+
+	if canRead {
+		activeSubscribers.Inc()
+		defer activeSubscribers.Dec()
+
+		wsSubscribe(conn, channel, uri, off, messageType, done)
+	} else {
+		<-done
+	}
+}
+
+// Sends the channel contents as websocket frames until the
+// channel is done or the client goes away.
+func wsSubscribe(conn *websocket.Conn, channel, uri string, off int64, messageType int, done <-chan bool) {
+	rd, err := openReader(channel, uri, off)
+	if err != nil {
+		if rd != nil {
+			rd.Close()
+		}
+		if err == broker.ErrNotRegistered {
+			conn.WriteClose(closeNotFound, "Channel is not registered.")
+		} else {
+			util.CountWithData("server.ws.sub.error", 1, "err=%s", err)
+			conn.WriteClose(closeUnavailable, "Unable to read channel.")
+		}
+		return
+	}
+
+	if broker.NoContent(rd, off) {
+		rd.Close()
+		conn.WriteClose(websocket.CloseNormal, "")
+		return
+	}
+
+	// A nil packet makes keepalives show up as empty reads,
+	// which we turn into pings.
+	ka := newKeepAliveReader(rd, nil, *util.HeartbeatDuration, done)
+	defer ka.Close()
+
+	buf := make([]byte, 32*1024)
+	var pending []byte
+
+	for {
+		n, err := ka.Read(buf)
+
+		if n > 0 {
+			p := append(pending, buf[:n]...)
+			pending = nil
+
+			// Text frames must be valid UTF-8, so hold back
+			// a trailing partial character until the rest of
+			// it arrives.
+			if messageType == websocket.TextMessage && err == nil {
+				p, pending = util.SplitUTF8(p)
+			}
+
+			if len(p) > 0 {
+				if conn.WriteMessage(messageType, p) != nil {
+					return
+				}
+			}
+		} else if err == nil {
+			if conn.WriteMessage(websocket.PingMessage, nil) != nil {
+				return
+			}
+		}
+
+		if err == io.EOF {
+			conn.WriteClose(websocket.CloseNormal, "")
+			return
+		}
+
+		if err != nil {
+			util.CountWithData("server.ws.sub.error", 1, "err=%s", err)
+			conn.WriteClose(websocket.CloseInternalError, "")
+			return
+		}
+	}
+}
+
+// Publishes every message the client sends to the channel.
+// The writer is only opened on the first message, so
+// subscribe-only clients never mark the channel done.
+func wsPublish(conn *websocket.Conn, channel, uri string, allowed bool) {
+	var writer io.WriteCloser
+	var stored chan struct{}
+
+	defer func() {
+		if writer != nil {
+			writer.Close()
+			close(stored)
+			storeFinal(channel, uri)
+			activePublishers.Dec()
+		}
+	}()
+
+	for {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if len(p) == 0 {
+			continue
+		}
+
+		if !allowed {
+			conn.WriteClose(closeForbidden, errForbidden.Error())
+			return
+		}
+
+		if writer == nil {
+			if writer, err = newPublishWriter(channel); err != nil {
+				writer = nil
+				if err == broker.ErrNotRegistered {
+					conn.WriteClose(closeNotFound, "Channel is not registered.")
+				} else {
+					conn.WriteClose(closeUnavailable, "Unable to publish.")
+				}
+				return
+			}
+
+			writer = &instrumentedWriter{writer}
+			activePublishers.Inc()
+
+			stored = make(chan struct{})
+			go storePeriodically(channel, uri, stored)
+			util.Count("server.ws.pub.start")
+		}
+
+		if _, err := writer.Write(p); err != nil {
+			if err == broker.ErrStreamFull {
+				conn.WriteClose(closeStreamFull, "Stream is full.")
+			} else if err == broker.ErrNotRegistered {
+				conn.WriteClose(closeNotFound, "Channel is not registered.")
+			} else if err, ok := err.(*recordError); ok {
+				conn.WriteClose(closeInvalidRecord, err.Error())
+			} else {
+				util.CountWithData("server.ws.pub.error", 1, "err=%s", err)
+				conn.WriteClose(websocket.CloseInternalError, "")
+			}
+			return
+		}
+	}
+}
+
+// Returns the origins of -webSocketOrigins.
+func webSocketOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(*util.WebSocketOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// The query parameters the websocket endpoint consumes are
+// left out of the storage URI.
+func wsRequestURI(r *http.Request) string {
+	return requestURIWithout(r, "mode", "offset", "token")
+}
@@ -0,0 +1,78 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+type recordEncoder struct {
+	reader  io.Reader
+	records *bufio.Reader
+	keep    func(record []byte) bool
+	opts    Options
+	offset  int64  // offset right after the last record read
+	pending []byte // encoded events not yet returned
+	started bool
+	err     error
+}
+
+// Encodes each newline terminated record of r as a single event,
+// its ID being the offset right after the record, so resuming
+// from it starts with the next record. Records keep rejects are
+// skipped; a nil keep emits every record. The events of opts are
+// added as with NewEncoderWithOptions.
+func NewRecordEncoder(r io.Reader, keep func(record []byte) bool, opts Options) io.Reader {
+	return &recordEncoder{reader: r, records: bufio.NewReader(r), keep: keep, opts: opts}
+}
+
+func (r *recordEncoder) Seek(offset int64, whence int) (n int64, err error) {
+	if seeker, ok := r.reader.(io.ReadSeeker); ok {
+		r.offset, err = seeker.Seek(offset, whence)
+	} else {
+		r.offset += offset
+	}
+	r.records.Reset(r.reader)
+
+	return r.offset, err
+}
+
+func (r *recordEncoder) Read(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		r.pending = r.opts.head()
+	}
+
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		// The last record may lack its newline.
+		record, err := r.records.ReadBytes('\n')
+		r.offset += int64(len(record))
+		r.err = err
+
+		record = bytes.TrimRight(record, "\r\n")
+		if len(record) > 0 && (r.keep == nil || r.keep(record)) {
+			r.pending = r.format(record)
+		}
+
+		if err == io.EOF {
+			r.pending = append(r.pending, r.opts.tail(r.offset)...)
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *recordEncoder) format(record []byte) []byte {
+	e := Event{ID: strconv.FormatInt(r.offset, 10), Data: record}
+	if r.opts.RecordType != nil {
+		e.Type = r.opts.RecordType(record)
+	}
+	return e.Bytes()
+}
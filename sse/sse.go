@@ -4,22 +4,108 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-)
+	"strconv"
+	"time"
 
-const (
-	id   = "id: %d\n"
-	data = "data: %s\n"
+	"github.com/heroku/busl/util"
 )
 
+// Event is a single server-sent event. Empty fields
+// are left out.
+type Event struct {
+	ID    string
+	Type  string        // `event:` field, defaults to message on the client
+	Retry time.Duration // reconnection time hinted to the client
+	Data  []byte        // one `data:` field per line, whatever its line break
+}
+
+func (e Event) Bytes() []byte {
+	buf := &bytes.Buffer{}
+
+	if e.ID != "" {
+		fmt.Fprintf(buf, "id: %s\n", e.ID)
+	}
+	if e.Type != "" {
+		fmt.Fprintf(buf, "event: %s\n", e.Type)
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(buf, "retry: %d\n", e.Retry/time.Millisecond)
+	}
+	if e.Data != nil {
+		for _, line := range splitLines(e.Data) {
+			fmt.Fprintf(buf, "data: %s\n", line)
+		}
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+// Options add events around the data of a stream.
+type Options struct {
+	// Sent on connect, unless zero.
+	Retry time.Duration
+
+	// Sent on connect, before any data.
+	Head []Event
+
+	// Called once the reader is exhausted with the offset it
+	// ended at, for the events closing the stream (e.g. `end`).
+	Tail func(offset int64) []Event
+
+	// Names the event of each record, for NewRecordEncoder.
+	// Records it names "" are sent as plain messages.
+	RecordType func(record []byte) string
+}
+
+func (o *Options) head() []byte {
+	var buf []byte
+	if o.Retry > 0 {
+		buf = append(buf, Event{Retry: o.Retry}.Bytes()...)
+	}
+	for _, e := range o.Head {
+		buf = append(buf, e.Bytes()...)
+	}
+	return buf
+}
+
+func (o *Options) tail(offset int64) []byte {
+	if o.Tail == nil {
+		return nil
+	}
+
+	var buf []byte
+	for _, e := range o.Tail(offset) {
+		buf = append(buf, e.Bytes()...)
+	}
+	return buf
+}
+
+// Size of the reads from the underlying reader. Each read
+// becomes one event, however small the caller's buffer is.
+const readSize = 32 << 10
+
 type encoder struct {
-	reader io.Reader // stores the original reader
-	offset int64     // offset for Seek purposes
+	reader  io.Reader // stores the original reader
+	offset  int64     // offset right after the data encoded so far
+	opts    Options
+	buf     []byte // raw read buffer
+	held    []byte // incomplete UTF-8 sequence ending the last read
+	skipLF  bool   // the last read ended with a \r, a leading \n pairs with it
+	pending []byte // encoded events not yet returned
+	started bool
+	err     error
 }
 
 func NewEncoder(r io.Reader) io.Reader {
 	return &encoder{reader: r}
 }
 
+// Returns an encoder adding the events of opts.
+func NewEncoderWithOptions(r io.Reader, opts Options) io.Reader {
+	return &encoder{reader: r, opts: opts}
+}
+
 func (r *encoder) Seek(offset int64, whence int) (n int64, err error) {
 	if seeker, ok := r.reader.(io.ReadSeeker); ok {
 		r.offset, err = seeker.Seek(offset, whence)
@@ -29,32 +115,91 @@ func (r *encoder) Seek(offset int64, whence int) (n int64, err error) {
 		// properly reflect the adjusted offset.
 		r.offset += offset
 	}
+	r.held = nil
+	r.skipLF = false
 
 	return r.offset, err
 }
 
-// FIXME: this version is simplified and assumes
-// that len(p) is always greater than the potential
-// length of data to be read.
-func (r *encoder) Read(p []byte) (n int, err error) {
-	n, err = r.reader.Read(p)
+// Encodes whole reads from the underlying reader, and drains
+// the result across as many calls as p requires.
+func (r *encoder) Read(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		r.pending = r.opts.head()
+	}
 
-	if n > 0 {
-		buf := format(r.offset, p[:n])
-		r.offset += int64(n)
-		n = copy(p, buf)
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
 	}
 
-	return n, err
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
 }
 
-func format(pos int64, msg []byte) []byte {
-	buf := bytes.NewBufferString(fmt.Sprintf(id, pos+int64(len(msg))))
+func (r *encoder) fill() {
+	if r.buf == nil {
+		r.buf = make([]byte, readSize)
+	}
+
+	n, err := r.reader.Read(r.buf)
+	msg := append(r.held, r.buf[:n]...)
+	r.held = nil
 
-	for _, line := range bytes.Split(msg, []byte{'\n'}) {
-		buf.WriteString(fmt.Sprintf(data, line))
+	// A rune split across reads would end up split
+	// across events, so it waits for the next read.
+	if err == nil {
+		var rest []byte
+		msg, rest = util.SplitUTF8(msg)
+		r.held = append([]byte(nil), rest...)
 	}
-	buf.Write([]byte{'\n'})
 
-	return buf.Bytes()
+	if len(msg) > 0 {
+		r.pending = r.format(msg)
+	}
+
+	if err != nil {
+		r.err = err
+		if err == io.EOF {
+			r.pending = append(r.pending, r.opts.tail(r.offset)...)
+		}
+	}
+}
+
+// Formats msg as an event, its ID being the offset right
+// after it. A \r\n split across reads is a single line break.
+func (r *encoder) format(msg []byte) []byte {
+	r.offset += int64(len(msg))
+	if r.skipLF && msg[0] == '\n' {
+		msg = msg[1:]
+	}
+	r.skipLF = len(msg) > 0 && msg[len(msg)-1] == '\r'
+
+	if len(msg) == 0 {
+		return nil
+	}
+	return Event{ID: strconv.FormatInt(r.offset, 10), Data: msg}.Bytes()
+}
+
+// Splits p into lines, which end with \r\n, \n or \r as in
+// the EventSource spec. A trailing line break is followed
+// by an empty line.
+func splitLines(p []byte) [][]byte {
+	var lines [][]byte
+	for {
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			return append(lines, p)
+		}
+		lines = append(lines, p[:i])
+
+		if p[i] == '\r' && i+1 < len(p) && p[i+1] == '\n' {
+			i++
+		}
+		p = p[i+1:]
+	}
 }
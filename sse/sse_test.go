@@ -3,8 +3,11 @@ package sse
 import (
 	"io"
 	"io/ioutil"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
 )
@@ -59,3 +62,155 @@ func readstring(r io.Reader) string {
 	buf, _ := ioutil.ReadAll(r)
 	return string(buf)
 }
+
+func TestRecordEncoder(t *testing.T) {
+	input := "{\"level\":\"info\"}\n{\"level\":\"error\"}\r\n{\"level\":\r\"info\"}"
+
+	enc := NewRecordEncoder(strings.NewReader(input), nil, Options{})
+	assert.Equal(t, "id: 17\ndata: {\"level\":\"info\"}\n\n"+
+		"id: 36\ndata: {\"level\":\"error\"}\n\n"+
+		"id: 53\ndata: {\"level\":\ndata: \"info\"}\n\n", readstring(enc))
+
+	// Skipped records still move the IDs along.
+	enc = NewRecordEncoder(strings.NewReader(input), func(record []byte) bool {
+		return strings.Contains(string(record), "error")
+	}, Options{})
+	assert.Equal(t, "id: 36\ndata: {\"level\":\"error\"}\n\n", readstring(enc))
+
+	r := strings.NewReader(input)
+	enc = NewRecordEncoder(r, nil, Options{})
+	enc.(io.Seeker).Seek(17, 0)
+	assert.Equal(t, "id: 36\ndata: {\"level\":\"error\"}\n\n"+
+		"id: 53\ndata: {\"level\":\ndata: \"info\"}\n\n", readstring(enc))
+}
+
+func TestRecordEncoderSmallReads(t *testing.T) {
+	enc := NewRecordEncoder(strings.NewReader("{\"a\":1}\n{\"b\":2}\n"), nil, Options{})
+
+	var out []byte
+	p := make([]byte, 3)
+	for {
+		n, err := enc.Read(p)
+		out = append(out, p[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, "id: 8\ndata: {\"a\":1}\n\nid: 16\ndata: {\"b\":2}\n\n", string(out))
+}
+
+func TestRecordEncoderType(t *testing.T) {
+	input := "{\"source\":\"stdout\"}\n{\"source\":\"\"}\n"
+
+	enc := NewRecordEncoder(strings.NewReader(input), nil, Options{
+		RecordType: func(record []byte) string {
+			return strings.Split(string(record), "\"")[3]
+		},
+	})
+	assert.Equal(t, "id: 20\nevent: stdout\ndata: {\"source\":\"stdout\"}\n\n"+
+		"id: 34\ndata: {\"source\":\"\"}\n\n", readstring(enc))
+}
+
+func TestEvent(t *testing.T) {
+	assert.Equal(t, "id: 5\nevent: end\nretry: 2000\ndata: a\ndata: b\n\n",
+		string(Event{ID: "5", Type: "end", Retry: 2 * time.Second, Data: []byte("a\nb")}.Bytes()))
+	assert.Equal(t, "retry: 1500\n\n", string(Event{Retry: 1500 * time.Millisecond}.Bytes()))
+}
+
+func TestEncoderOptions(t *testing.T) {
+	opts := Options{
+		Retry: time.Second,
+		Head:  []Event{{Type: "source", Data: []byte("broker")}},
+		Tail: func(offset int64) []Event {
+			return []Event{{Type: "end", Data: []byte(strconv.FormatInt(offset, 10))}}
+		},
+	}
+
+	enc := NewEncoderWithOptions(strings.NewReader("hello"), opts)
+	assert.Equal(t, "retry: 1000\n\nevent: source\ndata: broker\n\nid: 5\ndata: hello\n\nevent: end\ndata: 5\n\n", readstring(enc))
+
+	enc = NewRecordEncoder(strings.NewReader("{}\n"), nil, opts)
+	assert.Equal(t, "retry: 1000\n\nevent: source\ndata: broker\n\nid: 3\ndata: {}\n\nevent: end\ndata: 3\n\n", readstring(enc))
+
+	// No tail when the reader doesn't end.
+	enc = NewEncoderWithOptions(io.MultiReader(strings.NewReader("hello"), &failingReader{}), Options{Tail: opts.Tail})
+	data, err := ioutil.ReadAll(enc)
+	assert.Equal(t, "id: 5\ndata: hello\n\n", string(data))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func readWith(r io.Reader, size int) string {
+	var out []byte
+	p := make([]byte, size)
+	for {
+		n, err := r.Read(p)
+		out = append(out, p[:n]...)
+		if err != nil {
+			return string(out)
+		}
+	}
+}
+
+func TestSmallBuffers(t *testing.T) {
+	for _, data := range testdata {
+		for size := 1; size <= 24; size++ {
+			enc := NewEncoder(strings.NewReader(data.input))
+			enc.(io.Seeker).Seek(data.offset, 0)
+			assert.Equal(t, data.output, readWith(enc, size), "buffer of %d bytes", size)
+		}
+	}
+
+	// Framing alone can take more room than the data.
+	input := strings.Repeat("\n", 100)
+	expected := "id: 100\n" + strings.Repeat("data: \n", 101) + "\n"
+	for _, size := range []int{1, 3, 7, 64, 100} {
+		assert.Equal(t, expected, readWith(NewEncoder(strings.NewReader(input)), size))
+	}
+}
+
+func TestSplitReads(t *testing.T) {
+	for _, data := range []struct {
+		input  string
+		output string
+	}{
+		// Runes aren't split across events.
+		{"hé!", "id: 1\ndata: h\n\nid: 3\ndata: é\n\nid: 4\ndata: !\n\n"},
+		{"€", "id: 3\ndata: €\n\n"},
+		// Nor are line breaks.
+		{"a\r\nb", "id: 1\ndata: a\n\nid: 2\ndata: \ndata: \n\nid: 4\ndata: b\n\n"},
+		{"a\r\rb", "id: 1\ndata: a\n\nid: 2\ndata: \ndata: \n\nid: 3\ndata: \ndata: \n\nid: 4\ndata: b\n\n"},
+		// Incomplete sequences are flushed at the end.
+		{"\xe2\x82", "id: 2\ndata: \xe2\x82\n\n"},
+	} {
+		enc := NewEncoder(iotest.OneByteReader(strings.NewReader(data.input)))
+		assert.Equal(t, data.output, readWith(enc, 1), data.input)
+
+		enc = NewEncoder(iotest.OneByteReader(strings.NewReader(data.input)))
+		assert.Equal(t, data.output, readstring(enc), data.input)
+	}
+}
+
+func TestLineBreaks(t *testing.T) {
+	for input, output := range map[string]string{
+		"a\nb":     "id: 3\ndata: a\ndata: b\n\n",
+		"a\r\nb":   "id: 4\ndata: a\ndata: b\n\n",
+		"a\rb":     "id: 3\ndata: a\ndata: b\n\n",
+		"a\n\rb":   "id: 4\ndata: a\ndata: \ndata: b\n\n",
+		"a\r\n\nb": "id: 5\ndata: a\ndata: \ndata: b\n\n",
+		"\r":       "id: 1\ndata: \ndata: \n\n",
+	} {
+		assert.Equal(t, output, readstring(NewEncoder(strings.NewReader(input))), input)
+	}
+}
+
+func TestDataErrReader(t *testing.T) {
+	// Data returned along with io.EOF is still encoded.
+	enc := NewEncoder(iotest.DataErrReader(strings.NewReader("hello")))
+	assert.Equal(t, "id: 5\ndata: hello\n\n", readWith(enc, 2))
+}
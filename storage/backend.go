@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"io"
+
+	"github.com/heroku/busl/util"
+)
+
+// Backend is where streams get persisted. Implementations
+// return ErrNotFound for missing streams, and ErrRange when
+// reading past the end of one. Err5xx marks transient errors
+// worth retrying.
+//
+// Objects are stored along with their Meta. Offsets passed to
+// Get point into the stored bytes, which is meaningless for
+// compressed objects: those are returned whole instead, for
+// the caller to decode.
+type Backend interface {
+	Put(requestURI string, reader io.Reader, meta Meta) error
+	Get(requestURI string, offset int64) (io.ReadCloser, Meta, error)
+	Delete(requestURI string) error
+	Stat(requestURI string) (Meta, error)
+}
+
+// Talks to an HTTP blob store such as S3, resolving
+// requestURIs under `STORAGE_BASE_URL`.
+type httpBackend struct{}
+
+// Picks the backend from the scheme of `STORAGE_BASE_URL`,
+// signing requests ourselves when S3 credentials are set.
+func backend() (Backend, error) {
+	base, err := baseURI()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case base.Scheme == "file":
+		return newFileBackend(base.Path), nil
+	case *util.S3AccessKeyID != "":
+		return newS3Backend(), nil
+	}
+	return httpBackend{}, nil
+}
@@ -1,18 +1,28 @@
 package storage
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/heroku/busl/crypt"
+	"github.com/heroku/busl/metrics"
 	"github.com/heroku/busl/util"
 )
 
 // Number of times we should retry a failed HTTP request.
 const retries = 3
 
+var uploadDuration = metrics.NewHistogram("busl_storage_upload_duration_seconds",
+	"Time taken to upload a stream to the storage backend, retries included.",
+	[]float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60})
+
 var (
 	ErrNoStorage = errors.New("No storage defined")
 	ErrNotFound  = errors.New("HTTP 404")
@@ -24,6 +34,13 @@ var (
 // with the given requestURI. The requestURI is resolved
 // using the `STORAGE_BASE_URL` as the base.
 //
+// A `file://` base URL stores streams on the local filesystem
+// instead of an HTTP blob store.
+//
+// With a `STORAGE_CODEC` set, the data is compressed before
+// being stored, and with `ENCRYPTION_KEYS` set, encrypted.
+// Get and Size transparently decode it.
+//
 // Retries transient errors `retries` number of times.
 //
 // Usage:
@@ -32,9 +49,40 @@ var (
 //   requestURI := "1/2/3?X-Amz-Algorithm=...&..."
 //   err := storage.Put(requestURI, reader)
 //
-func Put(requestURI string, reader io.Reader) (err error) {
+func Put(requestURI string, reader io.Reader) error {
+	return PutWithContentType(requestURI, reader, "")
+}
+
+// Same as Put, storing the content type of the data along
+// with it, as returned by ContentType.
+func PutWithContentType(requestURI string, reader io.Reader, contentType string) (err error) {
+	defer func(start time.Time) {
+		uploadDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	meta := Meta{Size: -1}
+	var data []byte
+	if *util.StorageCodec != "" || crypt.Enabled() {
+		if data, meta, err = encode(*util.StorageCodec, reader); err != nil {
+			util.Count("storage.put.error")
+			return err
+		}
+	}
+	meta.ContentType = contentType
+
+	// Data left as is is read straight from reader, which
+	// has to be rewound for a retry. Sending a drained one
+	// would store an empty object over the stream.
+	rewind := func() bool { return true }
+	if data == nil {
+		rewind = rewinder(reader)
+	}
+
 	for i := retries; i > 0; i-- {
-		err = put(requestURI, reader)
+		if data != nil {
+			reader = bytes.NewReader(data)
+		}
+		err = put(requestURI, reader, meta)
 
 		// Break if we get nil / any error other than Err5xx
 		if err == nil {
@@ -42,7 +90,7 @@ func Put(requestURI string, reader io.Reader) (err error) {
 			return nil
 		}
 
-		if err != Err5xx {
+		if err != Err5xx || !rewind() {
 			util.Count("storage.put.error")
 			return err
 		}
@@ -56,11 +104,100 @@ func Put(requestURI string, reader io.Reader) (err error) {
 	return err
 }
 
-func put(requestURI string, reader io.Reader) error {
+// Returns a func rewinding reader to where it is now,
+// reporting whether it could.
+func rewinder(reader io.Reader) func() bool {
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return func() bool { return false }
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	return func() bool {
+		if err != nil {
+			return false
+		}
+		_, err = seeker.Seek(start, io.SeekStart)
+		return err == nil
+	}
+}
+
+func put(requestURI string, reader io.Reader, meta Meta) error {
+	b, err := backend()
+	if err != nil {
+		return err
+	}
+	return b.Put(requestURI, reader, meta)
+}
+
+// Pre-signed URLs only cover the headers they were signed
+// with, so the decoded size isn't sent along.
+func (httpBackend) Put(requestURI string, reader io.Reader, meta Meta) error {
 	req, err := newRequest("PUT", requestURI, reader)
 	if err != nil {
 		return err
 	}
+	if meta.encoded() {
+		req.Header.Set("Content-Encoding", meta.contentEncoding())
+	}
+	if meta.ContentType != "" {
+		req.Header.Set("Content-Type", meta.ContentType)
+	}
+	res, err := process(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	return err
+}
+
+// Removes the data stored in requestURI.
+// The requestURI is resolved using the `STORAGE_BASE_URL` as the base.
+//
+// Retries transient errors `retries` number of times.
+//
+// Usage:
+//
+//   requestURI := "1/2/3?X-Amz-Algorithm=...&..."
+//   err := storage.Delete(requestURI)
+//
+func Delete(requestURI string) (err error) {
+	for i := retries; i > 0; i-- {
+		err = del(requestURI)
+
+		if err == nil {
+			util.Count("storage.delete.success")
+			return nil
+		}
+
+		if err != Err5xx {
+			util.Count("storage.delete.error")
+			return err
+		}
+
+		util.Count("storage.delete.retry")
+	}
+
+	// We've ran out of retries
+	util.Count("storage.delete.maxretries")
+	return err
+}
+
+func del(requestURI string) error {
+	b, err := backend()
+	if err != nil {
+		return err
+	}
+	if segmented(b) {
+		return deleteSegments(b, requestURI)
+	}
+	return b.Delete(requestURI)
+}
+
+func (httpBackend) Delete(requestURI string) error {
+	req, err := newRequest("DELETE", requestURI, nil)
+	if err != nil {
+		return err
+	}
 	res, err := process(req)
 	if res != nil {
 		defer res.Body.Close()
@@ -107,19 +244,143 @@ func Get(requestURI string, offset int64) (rd io.ReadCloser, err error) {
 }
 
 func get(requestURI string, offset int64) (io.ReadCloser, error) {
-	req, err := newRequest("GET", requestURI, nil)
+	b, err := backend()
 	if err != nil {
 		return nil, err
 	}
-	req.TransferEncoding = []string{"chunked"}
-	req.Header.Add("Transfer-Encoding", "chunked")
-	req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	if segmented(b) {
+		return getSegments(b, requestURI, offset)
+	}
+	return open(b, requestURI, offset)
+}
+
+func (httpBackend) Get(requestURI string, offset int64) (io.ReadCloser, Meta, error) {
+	return getRanged(func(offset int64) (*http.Response, error) {
+		req, err := newRequest("GET", requestURI, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Add("Transfer-Encoding", "chunked")
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+		return process(req)
+	}, offset)
+}
+
+// Fetches an object from offset. Ranges apply to the stored
+// bytes, so when the object turns out to be compressed (or
+// the range can't be satisfied, since the offset may be past
+// the compressed size) it is fetched again from the start.
+func getRanged(fetch func(offset int64) (*http.Response, error), offset int64) (io.ReadCloser, Meta, error) {
+	res, err := fetch(offset)
+
+	if offset > 0 && (err == ErrRange || err == nil && metaFromHeader(res.Header, -1).encoded()) {
+		if res != nil {
+			res.Body.Close()
+		}
+
+		res, err = fetch(0)
+		if err == nil && !metaFromHeader(res.Header, -1).encoded() {
+			res.Body.Close()
+			return nil, Meta{}, ErrRange
+		}
+	}
 
-	res, err := process(req)
 	if res == nil {
-		return nil, err
+		return nil, Meta{}, err
+	}
+	return res.Body, metaFromHeader(res.Header, -1), err
+}
+
+// Returns the size of the data stored in requestURI.
+// The requestURI is resolved using the `STORAGE_BASE_URL` as the base.
+//
+// Since pre-signed URLs are bound to a method, this issues a
+// single byte ranged GET rather than a HEAD.
+//
+// Retries transient errors `retries` number of times.
+func Size(requestURI string) (size int64, err error) {
+	for i := retries; i > 0; i-- {
+		size, err = stat(requestURI)
+
+		if err == nil {
+			util.Count("storage.size.success")
+			return size, nil
+		}
+
+		if err != Err5xx {
+			util.Count("storage.size.error")
+			return 0, err
+		}
+
+		util.Count("storage.size.retry")
+	}
+
+	// We've ran out of retries
+	util.Count("storage.size.maxretries")
+	return 0, err
+}
+
+// Returns the content type the data stored in requestURI was
+// put with, "" when none was given.
+func ContentType(requestURI string) (string, error) {
+	b, err := backend()
+	if err != nil {
+		return "", err
+	}
+	if segmented(b) {
+		requestURI = segmentURI(requestURI, 0)
+	}
+
+	meta, err := b.Stat(requestURI)
+	if err != nil {
+		util.Count("storage.contenttype.error")
+		return "", err
+	}
+	util.Count("storage.contenttype.success")
+	return meta.ContentType, nil
+}
+
+func stat(requestURI string) (int64, error) {
+	b, err := backend()
+	if err != nil {
+		return 0, err
+	}
+	if segmented(b) {
+		return sizeSegments(b, requestURI)
+	}
+	return size(b, requestURI)
+}
+
+func (httpBackend) Stat(requestURI string) (Meta, error) {
+	req, err := newRequest("GET", requestURI, nil)
+	if err != nil {
+		return Meta{}, err
+	}
+	req.Header.Add("Range", "bytes=0-0")
+
+	res, err := process(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	// A range can't be satisfied on empty blobs.
+	if err == ErrRange {
+		return Meta{}, nil
+	}
+	if err != nil {
+		return Meta{}, err
+	}
+
+	// Content-Range: bytes 0-0/<size>
+	if cr := res.Header.Get("Content-Range"); cr != "" {
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if size, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				return metaFromHeader(res.Header, size), nil
+			}
+		}
 	}
-	return res.Body, err
+	return metaFromHeader(res.Header, res.ContentLength), nil
 }
 
 // constructs an http.Request object, resolving requestURI
@@ -141,7 +402,8 @@ func newRequest(method, requestURI string, reader io.Reader) (*http.Request, err
 //   - ErrRange
 //
 func process(req *http.Request) (*http.Response, error) {
-	transport := &http.Transport{}
+	// Compressed objects are decoded by us, not the transport.
+	transport := &http.Transport{DisableCompression: true}
 	client := &http.Client{Transport: transport}
 
 	res, err := client.Do(req)
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
 	"github.com/heroku/busl/util"
@@ -102,6 +105,32 @@ func TestPut(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPutRetry(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	*util.StorageBaseURL = server.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	// Retries send the data again from the start.
+	assert.Nil(t, Put("1/2/3", strings.NewReader("hello")))
+	assert.Equal(t, []string{"hello", "hello"}, bodies)
+
+	// Readers which can't be rewound aren't retried.
+	bodies = nil
+	assert.Equal(t, Err5xx, Put("1/2/3", struct{ io.Reader }{strings.NewReader("hello")}))
+	assert.Equal(t, []string{"hello"}, bodies)
+}
+
 func TestGet(t *testing.T) {
 	_, requestURI := setup()
 	if requestURI == "" {
@@ -140,3 +169,69 @@ func TestGetIllegalOffset(t *testing.T) {
 		t.Fatalf("%v != Expected 200, got 416", err)
 	}
 }
+
+func TestDeleteWithoutBaseURL(t *testing.T) {
+	*util.StorageBaseURL = ""
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	err := Delete("1/2/3")
+	assert.Equal(t, err, ErrNoStorage)
+}
+
+func TestDelete(t *testing.T) {
+	var deleted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path != "/1/2/3" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		deleted = r.URL.RequestURI()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	*util.StorageBaseURL = server.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	assert.Nil(t, Delete("1/2/3?foo=bar"))
+	assert.Equal(t, "/1/2/3?foo=bar", deleted)
+	assert.Equal(t, ErrNotFound, Delete("4/5/6"))
+}
+
+func TestSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ranged":
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader("hello world"))
+		case "/full":
+			w.Write([]byte("hello"))
+		case "/empty":
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	*util.StorageBaseURL = server.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+
+	for uri, expected := range map[string]int64{"ranged": 11, "full": 5, "empty": 0} {
+		size, err := Size(uri)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, size)
+	}
+
+	_, err := Size("missing")
+	assert.Equal(t, ErrNotFound, err)
+}
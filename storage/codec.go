@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/klauspost/compress/zstd"
+	"github.com/heroku/busl/crypt"
+)
+
+// Codecs streams can be compressed with in storage. The names
+// double as the `Content-Encoding` of the stored objects.
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// Content coding of objects encrypted with the crypt
+// package, applied after compression.
+const encodingEncrypted = "busl-aes256gcm"
+
+// Header carrying the decoded size of encoded objects, as
+// S3 user metadata.
+const decodedSizeHeader = "X-Amz-Meta-Decoded-Size"
+
+// Meta describes how an object is stored: the codec it's
+// compressed with ("" when stored as is), whether it's
+// encrypted, and the size of its data once decoded, -1
+// when unknown. ContentType is the one of the stream, ""
+// for opaque bytes.
+type Meta struct {
+	Codec       string
+	Encrypted   bool
+	Size        int64
+	ContentType string
+}
+
+// Reports whether the stored bytes differ from the data.
+func (m Meta) encoded() bool {
+	return m.Codec != "" || m.Encrypted
+}
+
+// Returns the `Content-Encoding` of an object, listing
+// the codings in the order they were applied.
+func (m Meta) contentEncoding() string {
+	var codings []string
+	if m.Codec != "" {
+		codings = append(codings, m.Codec)
+	}
+	if m.Encrypted {
+		codings = append(codings, encodingEncrypted)
+	}
+	return strings.Join(codings, ", ")
+}
+
+// Stored as is, or with one of the codecs. Preferred in
+// this order, should a stream be found stored both ways.
+var codecs = []string{"", CodecGzip, CodecZstd}
+
+// Compresses reader into memory with codec, then encrypts
+// it when encryption is enabled, returning the stored data
+// along with its Meta.
+func encode(codec string, reader io.Reader) ([]byte, Meta, error) {
+	data, size, err := compress(codec, reader)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+
+	meta := Meta{Codec: codec, Size: size}
+	if crypt.Enabled() {
+		if data, err = crypt.Encrypt(data); err != nil {
+			return nil, Meta{}, err
+		}
+		meta.Encrypted = true
+	}
+	return data, meta, nil
+}
+
+// Compresses reader into memory, returning the
+// compressed data along with the decoded size.
+func compress(codec string, reader io.Reader) ([]byte, int64, error) {
+	if codec == "" {
+		data, err := ioutil.ReadAll(reader)
+		return data, int64(len(data)), err
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch codec {
+	case CodecGzip:
+		w = gzip.NewWriter(&buf)
+	case CodecZstd:
+		w, err = zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+	default:
+		err = fmt.Errorf("unknown storage codec %q", codec)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n, err := io.Copy(w, reader)
+	if err != nil {
+		w.Close()
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), n, nil
+}
+
+// Wraps rd with a reader decrypting and decompressing
+// it as described by meta. Closing it closes rd as well.
+func decode(meta Meta, rd io.ReadCloser) (io.ReadCloser, error) {
+	var src io.Reader = rd
+	if meta.Encrypted {
+		dec, err := crypt.NewReader(rd)
+		if err != nil {
+			return nil, err
+		}
+		src = dec
+	}
+
+	switch meta.Codec {
+	case "":
+		return &decoder{src, ioutil.NopCloser(nil), rd}, nil
+	case CodecGzip:
+		dec, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return &decoder{dec, dec, rd}, nil
+	case CodecZstd:
+		dec, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &decoder{dec, dec.IOReadCloser(), rd}, nil
+	}
+	return nil, fmt.Errorf("unknown storage codec %q", meta.Codec)
+}
+
+type decoder struct {
+	io.Reader
+	dec io.Closer
+	rd  io.Closer
+}
+
+func (d *decoder) Close() error {
+	d.dec.Close()
+	return d.rd.Close()
+}
+
+// Opens the object at requestURI from offset, decoding it if
+// need be. Offsets always point into the decoded data, so
+// encoded objects are read from their start, skipping up to
+// offset.
+func open(b Backend, requestURI string, offset int64) (io.ReadCloser, error) {
+	rd, meta, err := b.Get(requestURI, offset)
+	if err != nil || !meta.encoded() {
+		return rd, err
+	}
+
+	dec, err := decode(meta, rd)
+	if err != nil {
+		rd.Close()
+		return nil, err
+	}
+	if offset == 0 {
+		return dec, nil
+	}
+
+	// Same as a `Range: bytes=<offset>-` past the end.
+	buf := bufio.NewReader(dec)
+	if _, err = io.CopyN(ioutil.Discard, buf, offset); err == nil {
+		_, err = buf.Peek(1)
+	}
+	if err == io.EOF {
+		err = ErrRange
+	}
+	if err != nil {
+		dec.Close()
+		return nil, err
+	}
+	return &decoder{buf, dec, ioutil.NopCloser(nil)}, nil
+}
+
+// Returns the decoded size of the object at requestURI,
+// counting it out when the backend doesn't know.
+func size(b Backend, requestURI string) (int64, error) {
+	meta, err := b.Stat(requestURI)
+	if err != nil || meta.Size >= 0 {
+		return meta.Size, err
+	}
+
+	rd, err := open(b, requestURI, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+	return io.Copy(ioutil.Discard, rd)
+}
+
+// Reads the codings and, when present, the decoded size
+// of an object from the headers it was served with.
+func metaFromHeader(header http.Header, size int64) Meta {
+	meta := Meta{ContentType: header.Get("Content-Type")}
+	for _, coding := range strings.Split(header.Get("Content-Encoding"), ",") {
+		switch coding = strings.TrimSpace(coding); coding {
+		case CodecGzip, CodecZstd:
+			meta.Codec = coding
+		case encodingEncrypted:
+			meta.Encrypted = true
+		}
+	}
+
+	meta.Size = size
+	if meta.encoded() {
+		meta.Size = -1
+		if n, err := strconv.ParseInt(header.Get(decodedSizeHeader), 10, 64); err == nil {
+			meta.Size = n
+		}
+	}
+	return meta
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/heroku/busl/crypt"
+	"github.com/heroku/busl/util"
+)
+
+const testKey = "k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func withKeys(keys string) func() {
+	*util.EncryptionKeys = keys
+	return func() {
+		*util.EncryptionKeys = ""
+	}
+}
+
+func withCodec(codec string) func() {
+	*util.StorageCodec = codec
+	return func() {
+		*util.StorageCodec = ""
+	}
+}
+
+func readAll(t *testing.T, requestURI string, offset int64) string {
+	rd, err := Get(requestURI, offset)
+	assert.Nil(t, err)
+	if err != nil {
+		return ""
+	}
+	defer rd.Close()
+
+	data, err := ioutil.ReadAll(rd)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []string{CodecGzip, CodecZstd} {
+		data, meta, err := encode(codec, strings.NewReader("hello world"))
+		assert.Nil(t, err)
+		assert.Equal(t, Meta{Codec: codec, Size: 11}, meta)
+
+		rd, err := decode(meta, ioutil.NopCloser(bytes.NewReader(data)))
+		assert.Nil(t, err)
+		decoded, err := ioutil.ReadAll(rd)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello world", string(decoded))
+		assert.Nil(t, rd.Close())
+	}
+
+	_, _, err := encode("lzma", strings.NewReader("hello"))
+	assert.Error(t, err)
+}
+
+func TestMetaHeaders(t *testing.T) {
+	meta := Meta{Codec: CodecGzip, Encrypted: true, Size: 5}
+	assert.Equal(t, "gzip, busl-aes256gcm", meta.contentEncoding())
+
+	header := http.Header{}
+	header.Set("Content-Encoding", meta.contentEncoding())
+	header.Set(decodedSizeHeader, "5")
+	assert.Equal(t, meta, metaFromHeader(header, 42))
+
+	header.Del(decodedSizeHeader)
+	assert.Equal(t, int64(-1), metaFromHeader(header, 42).Size)
+	assert.Equal(t, Meta{Size: 42}, metaFromHeader(http.Header{}, 42))
+}
+
+func TestFileCompressed(t *testing.T) {
+	dir, cleanup := withFileStorage(t)
+	defer cleanup()
+	defer withCodec(CodecGzip)()
+
+	assert.Nil(t, Put("1/2/3", strings.NewReader("hello world")))
+
+	_, err := os.Stat(filepath.Join(dir, "1", "2", "3.stream.gz"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "1", "2", "3.stream"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, "hello world", readAll(t, "1/2/3", 0))
+	assert.Equal(t, "world", readAll(t, "1/2/3", 6))
+
+	_, err = Get("1/2/3", 11)
+	assert.Equal(t, ErrRange, err)
+
+	size, err := Size("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), size)
+
+	// Switching codecs replaces the stored copy.
+	*util.StorageCodec = ""
+	assert.Nil(t, Put("1/2/3", strings.NewReader("hello")))
+	_, err = os.Stat(filepath.Join(dir, "1", "2", "3.stream.gz"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "hello", readAll(t, "1/2/3", 0))
+
+	assert.Nil(t, Delete("1/2/3"))
+	assert.Equal(t, ErrNotFound, Delete("1/2/3"))
+}
+
+func TestFileDecodedSize(t *testing.T) {
+	dir, cleanup := withFileStorage(t)
+	defer cleanup()
+	defer withCodec(CodecGzip)()
+
+	assert.Nil(t, Put("1/2/3", strings.NewReader("hello world")))
+	b := &fileBackend{root: dir}
+
+	meta, err := b.Stat("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), meta.Size)
+
+	// A sidecar not matching the stored copy is ignored.
+	name := filepath.Join(dir, "1", "2", "3.stream.gz")
+	assert.Nil(t, ioutil.WriteFile(name, []byte("garbage"), 0644))
+	meta, err = b.Stat("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-1), meta.Size)
+
+	assert.Nil(t, b.Delete("1/2/3"))
+	_, err = os.Stat(name + sidecarExt)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSegmentsCompressed(t *testing.T) {
+	_, cleanup := withFileStorage(t)
+	defer cleanup()
+	defer withCodec(CodecZstd)()
+
+	assert.Nil(t, PutSegment("1/2/3", 0, strings.NewReader("hello")))
+	assert.Nil(t, PutSegment("1/2/3", 5, strings.NewReader(" world")))
+
+	assert.Equal(t, "hello world", readAll(t, "1/2/3", 0))
+	assert.Equal(t, "lo world", readAll(t, "1/2/3", 3))
+	assert.Equal(t, "rld", readAll(t, "1/2/3", 8))
+
+	size, err := Size("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), size)
+}
+
+func TestS3Compressed(t *testing.T) {
+	fake, cleanup := withFakeS3(t)
+	defer cleanup()
+	defer withCodec(CodecGzip)()
+
+	data := strings.Repeat("hello world ", 10)
+	assert.Nil(t, Put("1/2/3", strings.NewReader(data)))
+	assert.True(t, fake.parts > 1)
+	assert.Equal(t, "gzip", fake.headers["/bucket/1/2/3"].Get("Content-Encoding"))
+
+	assert.Equal(t, data, readAll(t, "1/2/3", 0))
+	assert.Equal(t, data[100:], readAll(t, "1/2/3", 100))
+
+	size, err := Size("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+}
+
+// Pre-signed URLs can't carry the decoded size, nor is the
+// range of a resume meaningful on the compressed object.
+func TestHTTPCompressed(t *testing.T) {
+	var mutex sync.Mutex
+	var object []byte
+	var encoding string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch r.Method {
+		case "PUT":
+			object, _ = ioutil.ReadAll(r.Body)
+			encoding = r.Header.Get("Content-Encoding")
+		case "GET":
+			w.Header().Set("Content-Encoding", encoding)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+		}
+	}))
+	defer server.Close()
+
+	*util.StorageBaseURL = server.URL
+	defer func() {
+		*util.StorageBaseURL = baseURL
+	}()
+	defer withCodec(CodecGzip)()
+
+	data := strings.Repeat("hello world ", 10)
+	assert.Nil(t, Put("1/2/3", strings.NewReader(data)))
+	assert.Equal(t, "gzip", encoding)
+
+	assert.Equal(t, data, readAll(t, "1/2/3", 0))
+	assert.Equal(t, data[100:], readAll(t, "1/2/3", 100))
+
+	_, err := Get("1/2/3", int64(len(data)))
+	assert.Equal(t, ErrRange, err)
+
+	size, err := Size("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+}
+
+func TestFileEncrypted(t *testing.T) {
+	dir, cleanup := withFileStorage(t)
+	defer cleanup()
+	defer withKeys(testKey)()
+
+	data := strings.Repeat("hello world ", 1000)
+	for _, codec := range []string{"", CodecZstd} {
+		*util.StorageCodec = codec
+		assert.Nil(t, Put("1/2/3", strings.NewReader(data)))
+
+		stored, err := ioutil.ReadFile(filepath.Join(dir, "1", "2", "3.stream"+codecExts[codec]+".enc"))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(stored, []byte("hello")))
+
+		assert.Equal(t, data, readAll(t, "1/2/3", 0))
+		assert.Equal(t, data[6000:], readAll(t, "1/2/3", 6000))
+
+		size, err := Size("1/2/3")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), size)
+	}
+	*util.StorageCodec = ""
+
+	// Unreadable once its key is gone.
+	*util.EncryptionKeys = "other:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+	_, err := Get("1/2/3", 0)
+	assert.Equal(t, crypt.ErrUnknownKey, err)
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Extension of the files streams are stored in, so that keys
+// like `1/2` and `1/2/3` can coexist as a file and a directory.
+const fileExt = ".stream"
+
+// Extensions appended to the files of compressed streams,
+// recording the codec used.
+var codecExts = map[string]string{
+	"":        "",
+	CodecGzip: ".gz",
+	CodecZstd: ".zst",
+}
+
+// Extension appended to the files of encrypted streams.
+const encryptedExt = ".enc"
+
+// Extension of the sidecar files recording the decoded size
+// and content type of a stream, next to the file it describes.
+const sidecarExt = ".meta"
+
+// Contents of a sidecar file. The size of the file it was
+// written for is kept, so a sidecar left over from an older
+// copy of the stream is ignored.
+type sidecar struct {
+	Size        int64  `json:"size"`
+	Stored      int64  `json:"stored"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Returns the extension recording how a stream is stored.
+func metaExt(meta Meta) string {
+	ext := codecExts[meta.Codec]
+	if meta.Encrypted {
+		ext += encryptedExt
+	}
+	return ext
+}
+
+// Lists every way a stream may be stored, in order
+// of preference.
+func fileVariants() []Meta {
+	var variants []Meta
+	for _, encrypted := range []bool{false, true} {
+		for _, codec := range codecs {
+			variants = append(variants, Meta{Codec: codec, Encrypted: encrypted, Size: -1})
+		}
+	}
+	return variants
+}
+
+// Stores streams under a local directory, laid out after
+// their keys: `1/2/3` goes to `<root>/1/2/3.stream`, or
+// `<root>/1/2/3.stream.gz.enc` when compressed with gzip
+// and encrypted.
+type fileBackend struct {
+	root string
+}
+
+func newFileBackend(root string) *fileBackend {
+	return &fileBackend{root: root}
+}
+
+// Maps a requestURI to its file, dropping the query string
+// (e.g. pre-signed URL params). The key is cleaned as an
+// absolute path first, so it can't escape the root.
+func (b *fileBackend) path(requestURI string) string {
+	if i := strings.Index(requestURI, "?"); i >= 0 {
+		requestURI = requestURI[:i]
+	}
+	key := path.Clean("/" + requestURI)
+	return filepath.Join(b.root, filepath.FromSlash(key)) + fileExt
+}
+
+// Finds the file the stream at requestURI is stored
+// in, along with how it's stored.
+func (b *fileBackend) find(requestURI string) (*os.File, Meta, error) {
+	name := b.path(requestURI)
+	for _, meta := range fileVariants() {
+		f, err := os.Open(name + metaExt(meta))
+		if os.IsNotExist(err) {
+			continue
+		}
+		return f, meta, err
+	}
+	return nil, Meta{}, ErrNotFound
+}
+
+// Writes to a temporary file next to the final one, which is
+// renamed into place once complete, so readers never see a
+// partial stream. Copies stored another way are then
+// removed.
+func (b *fileBackend) Put(requestURI string, reader io.Reader, meta Meta) error {
+	name := b.path(requestURI)
+	if _, ok := codecExts[meta.Codec]; !ok {
+		return fmt.Errorf("unknown storage codec %q", meta.Codec)
+	}
+	ext := metaExt(meta)
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	stored, err := io.Copy(tmp, reader)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	// Recording the decoded size spares decoding the
+	// whole stream to find it out.
+	if meta.encoded() && meta.Size >= 0 || meta.ContentType != "" {
+		if err := writeSidecar(name+ext, sidecar{meta.Size, stored, meta.ContentType}); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(name + ext + sidecarExt)
+	}
+	if err := os.Rename(tmp.Name(), name+ext); err != nil {
+		return err
+	}
+
+	for _, variant := range fileVariants() {
+		if other := metaExt(variant); other != ext {
+			os.Remove(name + other)
+			os.Remove(name + other + sidecarExt)
+		}
+	}
+	return nil
+}
+
+// Writes the sidecar of the file at name, renamed into place
+// as the file itself.
+func writeSidecar(name string, s sidecar) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name+sidecarExt)
+}
+
+// Reads the sidecar of the file at name, which must
+// hold stored bytes.
+func readSidecar(name string, stored int64) (sidecar, bool) {
+	var s sidecar
+	data, err := ioutil.ReadFile(name + sidecarExt)
+	if err != nil || json.Unmarshal(data, &s) != nil || s.Stored != stored {
+		return s, false
+	}
+	return s, true
+}
+
+func (b *fileBackend) Get(requestURI string, offset int64) (io.ReadCloser, Meta, error) {
+	f, meta, err := b.find(requestURI)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	if meta.encoded() {
+		return f, meta, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Meta{}, err
+	}
+
+	// Same as a `Range: bytes=<offset>-` past the end.
+	if offset > 0 && offset >= info.Size() {
+		f.Close()
+		return nil, Meta{}, ErrRange
+	}
+
+	if _, err := f.Seek(offset, 0); err != nil {
+		f.Close()
+		return nil, Meta{}, err
+	}
+	return f, Meta{Size: info.Size()}, nil
+}
+
+func (b *fileBackend) Delete(requestURI string) error {
+	name := b.path(requestURI)
+
+	err := ErrNotFound
+	for _, variant := range fileVariants() {
+		switch e := os.Remove(name + metaExt(variant)); {
+		case e == nil:
+			err = nil
+		case !os.IsNotExist(e):
+			return e
+		}
+		os.Remove(name + metaExt(variant) + sidecarExt)
+	}
+	return err
+}
+
+// The decoded size of encoded streams and the content type
+// are read from the sidecar. Without one, the size is left
+// to be counted out.
+func (b *fileBackend) Stat(requestURI string) (Meta, error) {
+	f, meta, err := b.find(requestURI)
+	if err != nil {
+		return Meta{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return Meta{}, err
+	}
+
+	if !meta.encoded() {
+		meta.Size = info.Size()
+	}
+	if s, ok := readSidecar(f.Name(), info.Size()); ok {
+		if meta.encoded() {
+			meta.Size = s.Size
+		}
+		meta.ContentType = s.ContentType
+	}
+	return meta, nil
+}
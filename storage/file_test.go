@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/heroku/busl/util"
+)
+
+func withFileStorage(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "busl-storage")
+	assert.Nil(t, err)
+
+	*util.StorageBaseURL = "file://" + dir
+	return dir, func() {
+		*util.StorageBaseURL = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFilePutGet(t *testing.T) {
+	dir, cleanup := withFileStorage(t)
+	defer cleanup()
+
+	err := Put("1/2/3?X-Amz-Algorithm=foo", strings.NewReader("hello world"))
+	assert.Nil(t, err)
+
+	// Laid out after the key, without the query.
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "1", "2", "3.stream"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(buf))
+
+	for offset, expected := range map[int64]string{0: "hello world", 6: "world", 10: "d"} {
+		rd, err := Get("1/2/3", offset)
+		assert.Nil(t, err)
+
+		buf, _ := ioutil.ReadAll(rd)
+		rd.Close()
+		assert.Equal(t, expected, string(buf))
+	}
+
+	_, err = Get("1/2/3", 11)
+	assert.Equal(t, ErrRange, err)
+
+	_, err = Get("4/5/6", 0)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestFilePutReplaces(t *testing.T) {
+	dir, cleanup := withFileStorage(t)
+	defer cleanup()
+
+	Put("1/2/3", strings.NewReader("hello world"))
+	Put("1/2/3", strings.NewReader("bye"))
+
+	size, err := Size("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), size)
+
+	// No temporary files are left behind.
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "1", "2"))
+	assert.Len(t, files, 1)
+}
+
+func TestFileNestedKeys(t *testing.T) {
+	_, cleanup := withFileStorage(t)
+	defer cleanup()
+
+	assert.Nil(t, Put("1/2", strings.NewReader("parent")))
+	assert.Nil(t, Put("1/2/3", strings.NewReader("child")))
+
+	size, _ := Size("1/2")
+	assert.Equal(t, int64(6), size)
+}
+
+func TestFileKeyEscape(t *testing.T) {
+	dir, cleanup := withFileStorage(t)
+	defer cleanup()
+
+	b := newFileBackend(dir)
+	assert.Equal(t, filepath.Join(dir, "etc", "passwd.stream"), b.path("../../etc/passwd"))
+}
+
+func TestFileContentType(t *testing.T) {
+	_, cleanup := withFileStorage(t)
+	defer cleanup()
+
+	assert.Nil(t, PutSegmentWithContentType("1/2/3", 0, strings.NewReader("{}\n"), "application/x-ndjson"))
+	assert.Nil(t, PutSegmentWithContentType("1/2/3", 3, strings.NewReader("[]\n"), "application/x-ndjson"))
+
+	contentType, err := ContentType("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, "application/x-ndjson", contentType)
+	assert.Equal(t, "{}\n[]\n", readAll(t, "1/2/3", 0))
+
+	// Streams put without one have none.
+	assert.Nil(t, Put("4/5/6", strings.NewReader("hello")))
+	contentType, err = ContentType("4/5/6")
+	assert.Nil(t, err)
+	assert.Equal(t, "", contentType)
+
+	_, err = ContentType("7/8/9")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestFileDeleteAndSize(t *testing.T) {
+	_, cleanup := withFileStorage(t)
+	defer cleanup()
+
+	_, err := Size("1/2/3")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, Delete("1/2/3"))
+
+	Put("1/2/3", strings.NewReader(""))
+	size, err := Size("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	assert.Nil(t, Delete("1/2/3"))
+	_, err = Get("1/2/3", 0)
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+// Talks to S3 (or any S3 compatible store) at `STORAGE_BASE_URL`,
+// signing requests with the configured credentials instead of
+// relying on pre-signed URLs. Streams larger than `S3PartSize`
+// are sent as multipart uploads.
+type s3Backend struct {
+	credentials
+}
+
+// Smallest part S3 accepts in a multipart upload, but for
+// the last one.
+const MinS3PartSize = 5 << 20
+
+func newS3Backend() *s3Backend {
+	region := *util.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Backend{credentials{
+		accessKeyID:     *util.S3AccessKeyID,
+		secretAccessKey: *util.S3SecretAccessKey,
+		sessionToken:    *util.S3SessionToken,
+		region:          region,
+	}}
+}
+
+// Builds a signed request for the object behind requestURI.
+// Any pre-signed params in requestURI are dropped, query
+// holds the S3 subresources (e.g. `uploads`) instead.
+func (b *s3Backend) newRequest(method, requestURI string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u, err := objectURL(requestURI)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, u.String(), rd)
+	if err != nil {
+		return nil, err
+	}
+	for name, vals := range header {
+		req.Header[name] = vals
+	}
+
+	b.sign(req, hashHex(body), time.Now())
+	return req, nil
+}
+
+// Resolves the object key under `STORAGE_BASE_URL`, keeping
+// the base path so path-style bucket URLs (e.g.
+// `https://s3.amazonaws.com/bucket/`) work.
+func objectURL(requestURI string) (*url.URL, error) {
+	if i := strings.Index(requestURI, "?"); i >= 0 {
+		requestURI = requestURI[:i]
+	}
+
+	u, err := baseURI()
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(requestURI, "/")
+	u.RawPath = ""
+	return u, nil
+}
+
+// Sends a signed request, retrying transient errors.
+// Only used where the body is held in memory.
+func (b *s3Backend) do(method, requestURI string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var res *http.Response
+	var err error
+
+	for i := retries; i > 0; i-- {
+		var req *http.Request
+		if req, err = b.newRequest(method, requestURI, query, header, body); err != nil {
+			return nil, err
+		}
+
+		if res, err = process(req); err != Err5xx {
+			return res, err
+		}
+		res.Body.Close()
+		util.Count("storage.s3.retry")
+	}
+	return res, err
+}
+
+// Encoded objects are stored with their codings as the
+// `Content-Encoding`, and their decoded size as metadata.
+func (b *s3Backend) Put(requestURI string, reader io.Reader, meta Meta) error {
+	header := http.Header{}
+	if meta.encoded() {
+		header.Set("Content-Encoding", meta.contentEncoding())
+		header.Set(decodedSizeHeader, strconv.FormatInt(meta.Size, 10))
+	}
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+
+	// Grows up to a part as it's read, so the small segments
+	// stored every interval don't take a whole one.
+	var part bytes.Buffer
+	n, err := part.ReadFrom(io.LimitReader(reader, *util.S3PartSize))
+	if err != nil {
+		return err
+	}
+
+	if n < *util.S3PartSize {
+		res, err := b.do("PUT", requestURI, nil, header, part.Bytes())
+		if res != nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	return b.putMultipart(requestURI, header, part.Bytes(), reader)
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// Uploads first, followed by the rest of reader, in parts of
+// `S3PartSize` bytes. The upload is aborted on failure, so no
+// parts are left behind.
+func (b *s3Backend) putMultipart(requestURI string, header http.Header, first []byte, reader io.Reader) (err error) {
+	res, err := b.do("POST", requestURI, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		if res != nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	var initiated initiateMultipartUploadResult
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	uploadID := initiated.UploadID
+	defer func() {
+		if err != nil {
+			util.Count("storage.s3.multipart.abort")
+			if res, _ := b.do("DELETE", requestURI, url.Values{"uploadId": {uploadID}}, nil, nil); res != nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	var complete completeMultipartUpload
+	part := first
+
+	for number := 1; len(part) > 0; number++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadID},
+		}
+
+		res, err := b.do("PUT", requestURI, query, nil, part)
+		if res != nil {
+			res.Body.Close()
+		}
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, completedPart{number, res.Header.Get("ETag")})
+
+		n, err := io.ReadFull(reader, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		part = part[:n]
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	res, err = b.do("POST", requestURI, url.Values{"uploadId": {uploadID}}, nil, body)
+	if res != nil {
+		// S3 may report a failed completion with a 200.
+		reply, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err == nil && bytes.Contains(reply, []byte("<Error>")) {
+			err = Err5xx
+		}
+	}
+
+	util.CountMany("storage.s3.multipart.parts", int64(len(complete.Parts)))
+	return err
+}
+
+func (b *s3Backend) Get(requestURI string, offset int64) (io.ReadCloser, Meta, error) {
+	return getRanged(func(offset int64) (*http.Response, error) {
+		header := http.Header{}
+		if offset > 0 {
+			header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		}
+
+		req, err := b.newRequest("GET", requestURI, nil, header, nil)
+		if err != nil {
+			return nil, err
+		}
+		return process(req)
+	}, offset)
+}
+
+func (b *s3Backend) Delete(requestURI string) error {
+	req, err := b.newRequest("DELETE", requestURI, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := process(req)
+	if res != nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+// Signed requests aren't bound to a method, so unlike
+// pre-signed URLs, a HEAD does the job.
+func (b *s3Backend) Stat(requestURI string) (Meta, error) {
+	req, err := b.newRequest("HEAD", requestURI, nil, nil, nil)
+	if err != nil {
+		return Meta{}, err
+	}
+	res, err := process(req)
+	if res != nil {
+		res.Body.Close()
+	}
+	if err != nil {
+		return Meta{}, err
+	}
+	return metaFromHeader(res.Header, res.ContentLength), nil
+}
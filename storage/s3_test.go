@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+	"github.com/heroku/busl/util"
+)
+
+// A tiny in-memory S3, checking request signatures.
+type fakeS3 struct {
+	t           *testing.T
+	credentials *credentials
+	mutex       sync.Mutex
+	objects     map[string][]byte
+	headers     map[string]http.Header
+	uploads     map[string]map[int][]byte
+	parts       int
+	failures    int // requests to fail with a 503 first
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	return &fakeS3{t: t, credentials: &newS3Backend().credentials, objects: map[string][]byte{}, headers: map[string]http.Header{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (s *fakeS3) verify(r *http.Request, body []byte) bool {
+	now, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil || r.Header.Get("X-Amz-Content-Sha256") != hashHex(body) {
+		return false
+	}
+
+	req, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for name, vals := range r.Header {
+		req.Header[name] = vals
+	}
+	req.Header.Del("Authorization")
+	s.credentials.sign(req, hashHex(body), now)
+
+	return req.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !s.verify(r, body) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	key := r.URL.Path
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == "POST" && query["uploads"] != nil:
+		id := strconv.Itoa(len(s.uploads) + 1)
+		s.uploads[id] = map[int][]byte{}
+		s.headers[key] = metaHeaders(r.Header)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		s.uploads[query.Get("uploadId")][number] = body
+		s.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, number))
+
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		var complete completeMultipartUpload
+		xml.Unmarshal(body, &complete)
+
+		parts := s.uploads[query.Get("uploadId")]
+		var numbers []int
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+
+		var object []byte
+		for i, number := range numbers {
+			assert.Equal(s.t, fmt.Sprintf(`"%d"`, number), complete.Parts[i].ETag)
+			object = append(object, parts[number]...)
+		}
+		s.objects[key] = object
+		delete(s.uploads, query.Get("uploadId"))
+
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+
+	case r.Method == "PUT":
+		s.objects[key] = body
+		s.headers[key] = metaHeaders(r.Header)
+
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		object, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, vals := range s.headers[key] {
+			w.Header()[name] = vals
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(object))
+	}
+}
+
+// The headers S3 keeps along with an object.
+func metaHeaders(header http.Header) http.Header {
+	meta := http.Header{}
+	for _, name := range []string{"Content-Encoding", "Content-Type", decodedSizeHeader} {
+		if val := header.Get(name); val != "" {
+			meta.Set(name, val)
+		}
+	}
+	return meta
+}
+
+func withFakeS3(t *testing.T) (*fakeS3, func()) {
+	*util.S3AccessKeyID = "AKID"
+	*util.S3SecretAccessKey = "secret"
+	*util.S3PartSize = 4
+
+	fake := newFakeS3(t)
+	server := httptest.NewServer(fake)
+	*util.StorageBaseURL = server.URL + "/bucket/"
+
+	return fake, func() {
+		server.Close()
+		*util.StorageBaseURL = ""
+		*util.S3AccessKeyID = ""
+		*util.S3SecretAccessKey = ""
+		*util.S3PartSize = 8 << 20
+	}
+}
+
+func TestS3PutGet(t *testing.T) {
+	fake, cleanup := withFakeS3(t)
+	defer cleanup()
+
+	// Pre-signed params are ignored.
+	err := Put("1/2/3?X-Amz-Algorithm=foo", strings.NewReader("hel"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hel", string(fake.objects["/bucket/1/2/3"]))
+	assert.Equal(t, 0, fake.parts)
+
+	rd, err := Get("1/2/3", 1)
+	assert.Nil(t, err)
+	buf, _ := ioutil.ReadAll(rd)
+	rd.Close()
+	assert.Equal(t, "el", string(buf))
+
+	size, err := Size("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), size)
+
+	_, err = Get("4/5/6", 0)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestS3Multipart(t *testing.T) {
+	fake, cleanup := withFakeS3(t)
+	defer cleanup()
+
+	err := Put("1/2/3", strings.NewReader("hello world"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(fake.objects["/bucket/1/2/3"]))
+	assert.Equal(t, 3, fake.parts)
+	assert.Empty(t, fake.uploads)
+
+	// Exact multiple of the part size.
+	err = Put("4/5/6", strings.NewReader("hellowor"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hellowor", string(fake.objects["/bucket/4/5/6"]))
+}
+
+func TestS3PutSmall(t *testing.T) {
+	fake, cleanup := withFakeS3(t)
+	defer cleanup()
+	*util.S3PartSize = 8 << 20
+
+	// A small segment doesn't take a whole part.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := Put("1/2/3", strings.NewReader("hello"))
+	runtime.ReadMemStats(&after)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(fake.objects["/bucket/1/2/3"]))
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 1<<20)
+}
+
+func TestS3ContentType(t *testing.T) {
+	fake, cleanup := withFakeS3(t)
+	defer cleanup()
+
+	// Set on the single part PUT and the multipart upload alike.
+	for _, data := range []string{"{}\n", "{\"a\":1}\n"} {
+		assert.Nil(t, PutSegmentWithContentType("1/2/3", 0, strings.NewReader(data), "application/x-ndjson"))
+
+		contentType, err := ContentType("1/2/3")
+		assert.Nil(t, err)
+		assert.Equal(t, "application/x-ndjson", contentType)
+	}
+	assert.True(t, fake.parts > 0)
+}
+
+func TestS3PutRetry(t *testing.T) {
+	fake, cleanup := withFakeS3(t)
+	defer cleanup()
+
+	// The retry is sent from the part read into memory,
+	// reader can't be rewound.
+	fake.failures = 1
+	err := Put("1/2/3", struct{ io.Reader }{strings.NewReader("hel")})
+	assert.Nil(t, err)
+	assert.Equal(t, "hel", string(fake.objects["/bucket/1/2/3"]))
+}
+
+func TestS3Delete(t *testing.T) {
+	fake, cleanup := withFakeS3(t)
+	defer cleanup()
+
+	Put("1/2/3", strings.NewReader("hi"))
+	assert.Nil(t, Delete("1/2/3"))
+	assert.Empty(t, fake.objects)
+}
+
+func TestS3BadSignature(t *testing.T) {
+	_, cleanup := withFakeS3(t)
+	defer cleanup()
+
+	*util.S3SecretAccessKey = "wrong"
+	err := Put("1/2/3", strings.NewReader("hi"))
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Streams persisted incrementally are stored as a chain of
+// segments: the first one under the stream's own key, each of
+// the following ones under `<key>.segment.<offset>`, offset
+// being where it starts in the stream. Reads follow the chain.
+const segmentSuffix = ".segment."
+
+type segment struct {
+	requestURI string
+	start      int64
+	size       int64
+}
+
+func segmentURI(requestURI string, offset int64) string {
+	if offset == 0 {
+		return requestURI
+	}
+
+	key, query := requestURI, ""
+	if i := strings.Index(requestURI, "?"); i >= 0 {
+		key, query = requestURI[:i], requestURI[i:]
+	}
+	return key + segmentSuffix + strconv.FormatInt(offset, 10) + query
+}
+
+// Reports whether streams can be stored in segments. Pre-signed
+// URLs are bound to a single key, so this requires a backend
+// we sign requests for ourselves, or the filesystem.
+func Segmented() bool {
+	b, err := backend()
+	return err == nil && segmented(b)
+}
+
+func segmented(b Backend) bool {
+	_, ok := b.(httpBackend)
+	return !ok
+}
+
+// Stores the part of the stream at requestURI starting at
+// offset. Segments must be put in order, each one starting
+// where the previous one ends.
+//
+// Usage:
+//
+//	err := storage.PutSegment("1/2/3", 0, strings.NewReader("hello"))
+//	err = storage.PutSegment("1/2/3", 5, strings.NewReader(" world"))
+func PutSegment(requestURI string, offset int64, reader io.Reader) error {
+	return PutSegmentWithContentType(requestURI, offset, reader, "")
+}
+
+// Same as PutSegment, storing the content type of the stream
+// along with the segment, as returned by ContentType.
+func PutSegmentWithContentType(requestURI string, offset int64, reader io.Reader, contentType string) error {
+	return PutWithContentType(segmentURI(requestURI, offset), reader, contentType)
+}
+
+// Walks the segment chain of the stream at requestURI.
+func segments(b Backend, requestURI string) ([]segment, error) {
+	var segs []segment
+	var start int64
+
+	for {
+		uri := segmentURI(requestURI, start)
+
+		n, err := size(b, uri)
+		if err == ErrNotFound && len(segs) > 0 {
+			return segs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		segs = append(segs, segment{uri, start, n})
+		if n == 0 {
+			return segs, nil
+		}
+		start += n
+	}
+}
+
+func getSegments(b Backend, requestURI string, offset int64) (io.ReadCloser, error) {
+	segs, err := segments(b, requestURI)
+	if err != nil {
+		return nil, err
+	}
+
+	last := segs[len(segs)-1]
+	if offset > 0 && offset >= last.start+last.size {
+		return nil, ErrRange
+	}
+
+	// Skip the segments before offset.
+	for len(segs) > 1 && offset >= segs[0].start+segs[0].size {
+		segs = segs[1:]
+	}
+
+	// Opening the first segment right away reports the
+	// errors of unreadable streams from Get.
+	r := &segmentReader{backend: b, segs: segs, offset: offset}
+	if err := r.next(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func sizeSegments(b Backend, requestURI string) (int64, error) {
+	segs, err := segments(b, requestURI)
+	if err != nil {
+		return 0, err
+	}
+
+	last := segs[len(segs)-1]
+	return last.start + last.size, nil
+}
+
+func deleteSegments(b Backend, requestURI string) error {
+	segs, err := segments(b, requestURI)
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		if err := b.Delete(seg.requestURI); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the segments one after the other, only
+// opening each one once the previous is exhausted.
+type segmentReader struct {
+	backend Backend
+	segs    []segment
+	offset  int64
+	current io.ReadCloser
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.segs) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Opens the next segment, from offset when it lies within.
+func (r *segmentReader) next() error {
+	seg := r.segs[0]
+	r.segs = r.segs[1:]
+
+	var offset int64
+	if r.offset > seg.start {
+		offset = r.offset - seg.start
+	}
+
+	rd, err := open(r.backend, seg.requestURI, offset)
+	if err != nil {
+		return err
+	}
+	r.current = rd
+	return nil
+}
+
+func (r *segmentReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestSegmentURI(t *testing.T) {
+	assert.Equal(t, "1/2/3", segmentURI("1/2/3", 0))
+	assert.Equal(t, "1/2/3.segment.5", segmentURI("1/2/3", 5))
+	assert.Equal(t, "1/2/3.segment.5?foo=bar", segmentURI("1/2/3?foo=bar", 5))
+}
+
+func TestSegmented(t *testing.T) {
+	assert.False(t, Segmented())
+
+	_, cleanup := withFileStorage(t)
+	defer cleanup()
+	assert.True(t, Segmented())
+}
+
+func TestSegments(t *testing.T) {
+	dir, cleanup := withFileStorage(t)
+	defer cleanup()
+
+	assert.Nil(t, PutSegment("1/2/3", 0, strings.NewReader("busl")))
+	assert.Nil(t, PutSegment("1/2/3", 4, strings.NewReader(" hello")))
+	assert.Nil(t, PutSegment("1/2/3", 10, strings.NewReader(" world")))
+
+	_, err := os.Stat(filepath.Join(dir, "1", "2", "3.segment.4.stream"))
+	assert.Nil(t, err)
+
+	size, err := Size("1/2/3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(16), size)
+
+	for offset, expected := range map[int64]string{
+		0:  "busl hello world",
+		2:  "sl hello world",
+		4:  " hello world",
+		12: "orld",
+		15: "d",
+	} {
+		rd, err := Get("1/2/3", offset)
+		assert.Nil(t, err)
+
+		buf, _ := ioutil.ReadAll(rd)
+		rd.Close()
+		assert.Equal(t, expected, string(buf))
+	}
+
+	_, err = Get("1/2/3", 16)
+	assert.Equal(t, ErrRange, err)
+
+	assert.Nil(t, Delete("1/2/3"))
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "1", "2"))
+	assert.Empty(t, files)
+
+	_, err = Get("1/2/3", 0)
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -10,15 +10,35 @@ import (
 
 var (
 	Creds              = flag.String("creds", os.Getenv("CREDS"), "user1:pass1|user2:pass2")
+	DefaultStreamTTL   = flag.Duration("defaultStreamTTL", time.Second*300, "Time a stream is kept after its last activity, unless specified on creation.")
+	EncryptionKeys     = flag.String("encryptionKeys", os.Getenv("ENCRYPTION_KEYS"), "Comma separated <id>:<base64 AES key> list to encrypt stream data at rest with. The first key encrypts new streams, the others are kept to read older ones.")
 	EnforceHTTPS       = flag.Bool("enforceHttps", os.Getenv("ENFORCE_HTTPS") == "1", "Whether to enforce use of HTTPS.")
 	HeartbeatDuration  = flag.Duration("subscribeHeartbeatDuration", time.Second*10, "Heartbeat interval for HTTP stream subscriptions.")
 	HttpPort           = flag.String("httpPort", os.Getenv("PORT"), "HTTP port for the server.")
 	HttpReadTimeout    = flag.Duration("httpReadTimeout", time.Hour, "Timeout for HTTP request reading")
 	HttpWriteTimeout   = flag.Duration("httpWriteTimeout", time.Hour, "Timeout for HTTP request writing")
+	LogMetrics         = flag.Bool("logMetrics", os.Getenv("LOG_METRICS") != "0", "Whether to also log counters as l2met style count# lines.")
+	MaxStreamSize      = flag.Int64("maxStreamSize", 0, "Maximum number of bytes a stream can hold (0 for unlimited).")
+	MaxStreamTTL       = flag.Duration("maxStreamTTL", time.Hour*24, "Maximum TTL a stream can be created with.")
+	RedactFlush        = flag.Duration("redactFlush", 0, "How long an incomplete line is held back before it's written out, but for the start of a literal secret (0 holds it until the line ends). A pattern split across writes further apart is only partly masked.")
+	RedactPatterns     = flag.String("redactPatterns", os.Getenv("REDACT_PATTERNS"), "Newline separated regular expressions masked out of published data. Only the first group is masked when a pattern has one.")
+	RedactSecrets      = flag.String("redactSecrets", os.Getenv("REDACT_SECRETS"), "Newline separated literal secrets masked out of published data.")
+	RedactWindow       = flag.Int("redactWindow", 4<<10, "Bytes of an incomplete line held back from subscribers, so that secrets split across writes are still masked.")
 	RollbarEnvironment = flag.String("rollbarEnvironment", os.Getenv("ROLLBAR_ENVIRONMENT"), "Rollbar Enviornment for this application (development/staging/production).")
 	RollbarToken       = flag.String("rollbarToken", os.Getenv("ROLLBAR_TOKEN"), "Rollbar Token for sending issues to Rollbar.")
+	S3AccessKeyID      = flag.String("s3AccessKeyId", os.Getenv("AWS_ACCESS_KEY_ID"), "Credentials to sign storage requests with, instead of relying on pre-signed URLs.")
+	S3PartSize         = flag.Int64("s3PartSize", 8<<20, "Streams larger than this are uploaded in parts of this size (5MB minimum).")
+	S3Region           = flag.String("s3Region", os.Getenv("AWS_REGION"), "Region of the storage bucket (defaults to us-east-1).")
+	S3SecretAccessKey  = flag.String("s3SecretAccessKey", os.Getenv("AWS_SECRET_ACCESS_KEY"), "Secret for -s3AccessKeyId.")
+	S3SessionToken     = flag.String("s3SessionToken", os.Getenv("AWS_SESSION_TOKEN"), "Optional session token for temporary credentials.")
+	SSERetry           = flag.Duration("sseRetry", 0, "Reconnection time hinted to event stream subscribers on connect (not sent when 0).")
 	StorageBaseURL     = flag.String("storageBaseURL", os.Getenv("STORAGE_BASE_URL"), "Optional persistent blob storage (i.e. S3)")
+	StorageCodec       = flag.String("storageCodec", os.Getenv("STORAGE_CODEC"), "Compress streams persisted to storage with this codec (gzip/zstd), or store them as is when empty.")
 	StorageInterval    = flag.Duration("storageInterval", time.Second*300, "Interval for persisting streams to backend storage.")
+	StreamOverflow     = flag.String("streamOverflow", "reject", "What to do with writes past -maxStreamSize (reject/truncate).")
+	TokenSecret        = flag.String("tokenSecret", os.Getenv("TOKEN_SECRET"), "Secret used to sign per-stream publish/read tokens. Tokens aren't required when empty.")
+	TokenTTL           = flag.Duration("tokenTTL", time.Hour*24, "How long issued stream tokens remain valid.")
+	WebSocketOrigins   = flag.String("webSocketOrigins", os.Getenv("WEBSOCKET_ORIGINS"), "Comma separated hosts or origins allowed to open websockets, besides the host busl is reached on.")
 )
 
 func init() {
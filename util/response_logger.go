@@ -1,7 +1,8 @@
 package util
 
 import (
-	"log"
+	"bufio"
+	"net"
 	"net/http"
 	"strconv"
 )
@@ -29,7 +30,12 @@ func (l *responseLogger) Flush() {
 	l.ResponseWriter.(http.Flusher).Flush()
 }
 
+func (l *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	l.status = http.StatusSwitchingProtocols
+	return l.ResponseWriter.(http.Hijacker).Hijack()
+}
+
 func (l *responseLogger) WriteLog() {
 	maskedStatus := strconv.Itoa(l.status/100) + "xx"
-	log.Printf("count#http.status.%s=1 status=%d request_id=%s", maskedStatus, l.status, l.requestID)
+	CountWithData("http.status."+maskedStatus, 1, "status=%d request_id=%s", l.status, l.requestID)
 }
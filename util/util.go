@@ -7,6 +7,9 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"unicode/utf8"
+
+	"github.com/heroku/busl/metrics"
 )
 
 func NewUUID() (string, error) {
@@ -44,11 +47,32 @@ func (s StringSliceUtil) Contains(check string) bool {
 	return false
 }
 
+// Splits p right before a trailing incomplete UTF-8
+// sequence, if there is one.
+func SplitUTF8(p []byte) ([]byte, []byte) {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i], p[i:]
+			}
+			break
+		}
+	}
+	return p, nil
+}
+
 func Count(metric string) { CountMany(metric, 1) }
 
 func CountMany(metric string, count int64) { CountWithData(metric, count, "") }
 
 func CountWithData(metric string, count int64, extraData string, v ...interface{}) {
+	name := "busl_" + metrics.Sanitize(metric) + "_total"
+	metrics.NewCounter(name, "Number of "+metric+" events.").Add(count)
+
+	if !*LogMetrics {
+		return
+	}
+
 	if extraData == "" {
 		log.Printf("count#%s=%d", metric, count)
 	} else {
@@ -0,0 +1,19 @@
+package util
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func TestSplitUTF8(t *testing.T) {
+	p := []byte("héllo ✓")
+
+	for i := 0; i <= len(p); i++ {
+		complete, rest := SplitUTF8(p[:i])
+		assert.True(t, utf8.Valid(complete))
+		assert.Equal(t, p[:i], append(complete, rest...))
+		assert.True(t, len(rest) < utf8.UTFMax)
+	}
+}
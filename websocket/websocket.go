@@ -0,0 +1,410 @@
+// Package websocket implements the subset of RFC 6455 busl needs:
+// the opening handshake, message framing, and ping/pong/close
+// control frames.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types, as defined by the frame opcodes.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// Close status codes.
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseTooBig        = 1009
+	CloseInternalError = 1011
+)
+
+const (
+	continuationFrame = 0
+
+	// Largest message we accept from a peer.
+	maxMessageSize = 1 << 20
+
+	// Magic value used to compute Sec-WebSocket-Accept.
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrBadOrigin    = errors.New("websocket: origin not allowed")
+	ErrProtocol     = errors.New("websocket: protocol error")
+	ErrTooBig       = errors.New("websocket: message too big")
+)
+
+// Conn is a websocket connection. Reads must come from a
+// single goroutine, writes can be issued concurrently.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // clients mask the frames they send
+
+	mutex  sync.Mutex // serializes writes
+	closed bool       // set once a close frame was sent
+}
+
+// Reports whether r asks for a websocket upgrade.
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return tokenListContains(r.Header, "Connection", "upgrade") &&
+		tokenListContains(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade completes the opening handshake of a websocket
+// request and takes over the underlying connection. Browsers
+// open websockets across sites, so requests from an origin
+// other than r.Host or one of origins are rejected.
+func Upgrade(w http.ResponseWriter, r *http.Request, origins []string) (*Conn, error) {
+	key := r.Header.Get("Sec-Websocket-Key")
+
+	if r.Method != "GET" || !IsWebSocketUpgrade(r) || key == "" {
+		http.Error(w, "Not a websocket handshake.", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version.", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+
+	if !checkOrigin(r, origins) {
+		http.Error(w, "Origin not allowed.", http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return nil, ErrBadHandshake
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop any deadlines the http server set for the request.
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", accept(key))
+
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: conn, br: brw.Reader}, nil
+}
+
+// Dial opens a client connection to a ws:// URL.
+func Dial(rawurl string, header http.Header) (*Conn, *http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols ||
+		res.Header.Get("Sec-Websocket-Accept") != accept(key) {
+		conn.Close()
+		return nil, res, ErrBadHandshake
+	}
+
+	return &Conn{conn: conn, br: br, client: true}, res, nil
+}
+
+// ReadMessage returns the next data message, reassembling
+// fragmented messages. Pings are answered and pongs dropped
+// along the way. Returns io.EOF once the peer closes.
+func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
+	messageType, p, err = c.readMessage()
+	if err == ErrProtocol {
+		c.WriteClose(CloseProtocolError, "")
+	}
+	return messageType, p, err
+}
+
+func (c *Conn) readMessage() (messageType int, p []byte, err error) {
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			c.WriteMessage(PongMessage, payload)
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			c.WriteClose(CloseNormal, "")
+			return 0, nil, io.EOF
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, ErrProtocol
+			}
+			messageType = opcode
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, ErrProtocol
+			}
+		default:
+			return 0, nil, ErrProtocol
+		}
+
+		if len(p)+len(payload) > maxMessageSize {
+			c.WriteClose(CloseTooBig, "")
+			return 0, nil, ErrTooBig
+		}
+		p = append(p, payload...)
+
+		if fin {
+			return messageType, p, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+
+	fin = head[0]&0x80 != 0
+	opcode = int(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7f)
+
+	// Reserved bits must be 0 since we don't negotiate
+	// extensions, and only clients mask their frames.
+	if head[0]&0x70 != 0 || masked == c.client {
+		return false, 0, nil, ErrProtocol
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	// Control frames can't be fragmented and are limited to 125 bytes.
+	if opcode >= CloseMessage && (!fin || length > 125) {
+		return false, 0, nil, ErrProtocol
+	}
+
+	if length < 0 || length > maxMessageSize {
+		c.WriteClose(CloseTooBig, "")
+		return false, 0, nil, ErrTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends p as a single frame.
+func (c *Conn) WriteMessage(messageType int, p []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	return c.writeFrame(messageType, p)
+}
+
+// WriteClose sends a close frame with the given status code.
+// Any subsequent writes fail.
+func (c *Conn) WriteClose(code int, reason string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	p := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	p = append(p, reason...)
+
+	return c.writeFrame(CloseMessage, p)
+}
+
+func (c *Conn) writeFrame(opcode int, p []byte) error {
+	buf := make([]byte, 0, 14+len(p))
+	buf = append(buf, 0x80|byte(opcode))
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch n := len(p); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		buf = append(buf, maskBit|127)
+		buf = append(buf, ext[:]...)
+	}
+
+	payload := p
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+
+		payload = make([]byte, len(p))
+		copy(payload, p)
+		maskBytes(mask, payload)
+	}
+	buf = append(buf, payload...)
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// Close tears down the underlying connection
+// without sending a close frame.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func accept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func maskBytes(mask [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= mask[i%4]
+	}
+}
+
+// Reports whether the Origin of r is allowed: its host is the
+// one r was sent to, or it's listed in origins, either as a host
+// or a full origin. Non-browser clients don't send one.
+func checkOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range origins {
+		if strings.EqualFold(allowed, u.Host) || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the comma separated header contains token.
+func tokenListContains(header http.Header, name, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/heroku/busl/Godeps/_workspace/src/github.com/stretchr/testify/assert"
+)
+
+func echoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, []string{"allowed.example.com"})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			messageType, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, p)
+		}
+	}))
+}
+
+func wsURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestAccept(t *testing.T) {
+	// Example from RFC 6455, section 1.3.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", accept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestOrigin(t *testing.T) {
+	server := echoServer()
+	defer server.Close()
+
+	for origin, allowed := range map[string]bool{
+		"":                                 true,
+		server.URL:                         true,
+		"https://allowed.example.com":      true,
+		"https://evil.example.com":         false,
+		"https://allowed.example.com.evil": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+
+		conn, resp, err := Dial(wsURL(server), header)
+		if allowed {
+			assert.Nil(t, err, origin)
+			conn.Close()
+		} else {
+			assert.Equal(t, ErrBadHandshake, err, origin)
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, origin)
+		}
+	}
+}
+
+func TestEcho(t *testing.T) {
+	server := echoServer()
+	defer server.Close()
+
+	conn, _, err := Dial(wsURL(server), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	messages := []struct {
+		messageType int
+		data        []byte
+	}{
+		{TextMessage, []byte("hello")},
+		{BinaryMessage, []byte{0, 1, 2, 3}},
+		{BinaryMessage, bytes.Repeat([]byte("a"), 200)},
+		{BinaryMessage, bytes.Repeat([]byte("b"), 70000)},
+	}
+
+	for _, m := range messages {
+		assert.Nil(t, conn.WriteMessage(m.messageType, m.data))
+
+		messageType, p, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, m.messageType, messageType)
+		assert.Equal(t, m.data, p)
+	}
+}
+
+func TestPingAndClose(t *testing.T) {
+	server := echoServer()
+	defer server.Close()
+
+	conn, _, err := Dial(wsURL(server), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// Pongs are consumed, so the next message is the echo.
+	conn.WriteMessage(PingMessage, []byte("ping"))
+	conn.WriteMessage(TextMessage, []byte("hello"))
+
+	_, p, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(p))
+
+	conn.WriteClose(CloseNormal, "")
+	_, _, err = conn.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+
+	assert.Equal(t, io.ErrClosedPipe, conn.WriteMessage(TextMessage, []byte("late")))
+}
+
+func TestBadHandshake(t *testing.T) {
+	server := echoServer()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}